@@ -1,26 +1,164 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/g3force/tcp-udp-mc-proxy/pkg/proxy"
+	"log"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 func main() {
 	flag.Usage = Usage
 	verbose := flag.Bool("verbose", false, "More verbose output")
+	balancing := flag.String("balancing", "roundrobin", "Strategy for choosing one of multiple tcp targets: roundrobin, random, leastconn or sourcehash")
+	proxyProtocol := flag.Int("proxy-protocol", 0, "Send a PROXY protocol header of this version (1 or 2) to tcp targets, 0 to disable")
+	acceptProxyProtocol := flag.Bool("accept-proxy-protocol", false, "Use the source address from PROXY protocol headers of tcp sources, if they send one. Only enable it if all sources are trusted proxies, as any source can claim any address")
+	requireProxyProtocol := flag.Bool("require-proxy-protocol", false, "Reject tcp sources without a valid PROXY protocol header")
+	tlsCert := flag.String("tls-cert", "", "Certificate file (PEM) for terminating TLS from tcp sources, reloaded on changes")
+	tlsKey := flag.String("tls-key", "", "Key file (PEM) for terminating TLS from tcp sources")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "Minimum TLS version for tcp sources: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "Comma separated list of allowed TLS 1.0-1.2 cipher suites for tcp sources")
+	tlsClientCa := flag.String("tls-client-ca", "", "CA file (PEM) for requiring client certificates from tcp sources")
+	tlsAlpn := flag.String("tls-alpn", "", "Comma separated list of ALPN protocols offered to tcp sources")
+	targetTls := flag.Bool("target-tls", false, "Connect to tcp targets with TLS")
+	targetTlsCa := flag.String("target-tls-ca", "", "CA file (PEM) for verifying tcp targets instead of the system CAs")
+	targetTlsCert := flag.String("target-tls-cert", "", "Client certificate file (PEM) for tcp targets, reloaded on changes")
+	targetTlsKey := flag.String("target-tls-key", "", "Client key file (PEM) for tcp targets")
+	targetTlsServerName := flag.String("target-tls-server-name", "", "Server name for verifying tcp targets instead of their host")
+	targetTlsInsecure := flag.Bool("target-tls-insecure", false, "Do not verify the certificates of tcp targets")
+	var sniRoutes routeFlags
+	flag.Var(&sniRoutes, "sni-route", "Route tls connections to tcp proxies by server name without terminating TLS: name=targets, for example *.example.com=a:443|b:443. Can be repeated. The targets of the proxy are the default")
+	var sniffRoutes, sniffRegexps routeFlags
+	flag.Var(&sniffRoutes, "sniff-route", "Route tcp connections by their detected protocol: protocol=targets, with protocol tls, http, http2, ssh or a name from -sniff-regexp. Can be repeated. The targets of the proxy are the fallback")
+	flag.Var(&sniffRegexps, "sniff-regexp", "Detect a custom protocol by a regular expression for the first bytes: name=regexp. Can be repeated")
+	sniffTimeout := flag.Duration("sniff-timeout", time.Second, "Maximum time to wait for the first bytes of a tcp connection for -sniff-route")
+	var httpRoutes routeFlags
+	flag.Var(&httpRoutes, "http-route", "Route requests of http proxies by host and path prefix: host/path=targets, for example example.com/api=a:80|b:80 or /static=c:80 for all hosts. Can be repeated. The targets of the proxy are the default")
+	var proxyUsers, destinationRules routeFlags
+	flag.Var(&proxyUsers, "proxy-user", "Require authentication for socks5 and connect proxies: user:password. Can be repeated")
+	flag.Var(&destinationRules, "destination-rule", "Allow or deny destinations of socks5 and connect proxies: 'allow|deny host[:port]' with a domain, *.domain, IP, CIDR or *. Can be repeated, the first matching rule decides. Without rules, all destinations are allowed, otherwise unmatched destinations are denied")
+	sourceSocketOptions := flag.String("source-socket-options", "", "Socket options for the sources of all proxies: comma separated keepalive=duration, keepalive-count=n, nodelay=true|false, rcvbuf=bytes, sndbuf=bytes, dscp=0-63, ttl=1-255 and mark=n, for example keepalive=30s,keepalive-count=4,dscp=46")
+	targetSocketOptions := flag.String("target-socket-options", "", "Socket options for the targets of all proxies, like -source-socket-options")
+	shutdownGracePeriod := flag.Duration("shutdown-grace-period", 10*time.Second, "Maximum time for finishing the sessions of all proxies on SIGINT or SIGTERM before they are closed. A second signal closes them right away")
+	accessLogPath := flag.String("access-log", "", "Append a JSON record for every closed session of tcp and udp proxies to this file, - for stdout")
+	udpIdleTimeout := flag.Duration("udp-idle-timeout", 0, "End the session of a udp source after this duration without datagrams, 0 to keep it until shutdown")
+	healthInterval := flag.Duration("health-interval", 0, "Interval for health checks of the targets of tcp and udp proxies, including the targets of routes, 0 to disable. Tcp targets are healthy, if a connection and, with -target-tls, a TLS handshake succeeds. Udp targets are healthy, if they respond to -health-send")
+	healthTimeout := flag.Duration("health-timeout", time.Second, "Timeout for a single health check")
+	healthSend := flag.String("health-send", "", "Payload of health checks, with escape sequences like \\r\\n. Tcp targets get it sent after connecting, if set")
+	healthExpect := flag.String("health-expect", "", "Expected prefix of the response of targets to health checks, with escape sequences like \\r\\n")
+	tcpIdleTimeout := flag.Duration("tcp-idle-timeout", 0, "Close a tcp session after this duration without data in any direction, 0 to disable")
+	tcpFirstByteTimeout := flag.Duration("tcp-first-byte-timeout", 0, "Close a tcp session, if the source sends no data within this duration after connecting, 0 to disable")
+	tcpMaxLifetime := flag.Duration("tcp-max-lifetime", 0, "Close a tcp session after this duration regardless of its activity, 0 to disable")
+	tcpMaxConnections := flag.Int("tcp-max-connections", 0, "Maximum number of concurrent sessions per tcp proxy, 0 for no limit")
+	tcpMaxConnectionsPerIP := flag.Int("tcp-max-connections-per-ip", 0, "Maximum number of concurrent sessions per source IP of a tcp proxy, 0 for no limit")
+	tcpAcceptQueueSize := flag.Int("tcp-accept-queue-size", 0, "Number of tcp sources that may wait for a free session, if a limit is reached. Others are rejected")
+	tcpAcceptQueueTimeout := flag.Duration("tcp-accept-queue-timeout", 0, "Maximum time a tcp source waits for a free session, 0 for no timeout")
+	tcpDialTimeout := flag.Duration("tcp-dial-timeout", 10*time.Second, "Timeout for a single connection attempt to a tcp target")
+	tcpDialRetries := flag.Int("tcp-dial-retries", 0, "Number of additional connection attempts to tcp targets, if the first one fails")
+	tcpDialBackoff := flag.Duration("tcp-dial-backoff", 100*time.Millisecond, "Initial wait time between connection attempts to tcp targets, doubled after each attempt")
+	tcpDialMaxBackoff := flag.Duration("tcp-dial-max-backoff", 5*time.Second, "Maximum wait time between connection attempts to tcp targets")
 	flag.Parse()
 
+	balancingStrategy, err := proxy.ParseBalancingStrategy(*balancing)
+	if err != nil {
+		Fprintf("%v\n", err)
+		os.Exit(1)
+	}
+	if *proxyProtocol < 0 || *proxyProtocol > 2 {
+		Fprintf("Unknown PROXY protocol version: %d\n", *proxyProtocol)
+		os.Exit(1)
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		tlsConfig, err = newTlsConfig(*tlsCert, *tlsKey, *tlsMinVersion, *tlsCiphers, *tlsAlpn)
+		if err == nil && *tlsClientCa != "" {
+			err = proxy.RequireClientCertificates(tlsConfig, *tlsClientCa)
+		}
+		if err != nil {
+			Fprintf("Invalid TLS configuration: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var targetTlsConfig *tls.Config
+	if *targetTls {
+		targetTlsConfig, err = proxy.NewClientTlsConfig(*targetTlsCa, *targetTlsCert, *targetTlsKey)
+		if err != nil {
+			Fprintf("Invalid target TLS configuration: %v\n", err)
+			os.Exit(1)
+		}
+		targetTlsConfig.ServerName = *targetTlsServerName
+		targetTlsConfig.InsecureSkipVerify = *targetTlsInsecure
+	}
+
+	users, err := parseUsers(proxyUsers)
+	if err != nil {
+		Fprintf("Invalid proxy user: %v\n", err)
+		os.Exit(1)
+	}
+	rules, err := parseDestinationRules(destinationRules)
+	if err != nil {
+		Fprintf("Invalid destination rule: %v\n", err)
+		os.Exit(1)
+	}
+
+	sourceOptions, err := parseSocketOptions(*sourceSocketOptions)
+	if err != nil {
+		Fprintf("Invalid source socket options: %v\n", err)
+		os.Exit(1)
+	}
+	targetOptions, err := parseSocketOptions(*targetSocketOptions)
+	if err != nil {
+		Fprintf("Invalid target socket options: %v\n", err)
+		os.Exit(1)
+	}
+
+	healthSendData, err := unescape(*healthSend)
+	var healthExpectData []byte
+	if err == nil {
+		healthExpectData, err = unescape(*healthExpect)
+	}
+	if err != nil {
+		Fprintf("Invalid health check payload: %v\n", err)
+		os.Exit(1)
+	}
+	newHealthChecker := func(network string, balancer *proxy.Balancer) *proxy.HealthChecker {
+		checker := proxy.NewHealthChecker(network, balancer)
+		checker.Interval = *healthInterval
+		checker.Timeout = *healthTimeout
+		checker.Send = healthSendData
+		checker.Expect = healthExpectData
+		return checker
+	}
+
+	accessLog, err := openAccessLog(*accessLogPath)
+	if err != nil {
+		Fprintf("Could not open access log: %v\n", err)
+		os.Exit(1)
+	}
+
 	var proxies []proxy.Proxy
 
 	for _, arg := range flag.Args() {
 		parts := strings.Split(arg, ",")
-		if len(parts) < 3 {
-			Fprintf("Expected a string with at least two ',': %s", arg)
+		// socks5 and connect proxies have no target address
+		minParts, nameIndex := 3, 3
+		if parts[0] == "socks5" || parts[0] == "connect" {
+			minParts, nameIndex = 2, 2
+		}
+		if len(parts) < minParts {
+			Fprintf("Expected a string with at least %d ',': %s", minParts-1, arg)
 			Usage()
 			os.Exit(1)
 		}
@@ -28,13 +166,102 @@ func main() {
 		var p proxy.Proxy
 		switch parts[0] {
 		case "tcp":
-			tcpProxy := proxy.NewTcpProxy(parts[1], parts[2])
+			targets, err := proxy.ParseTargets(parts[2])
+			if err != nil {
+				Fprintf("Invalid targets: %v\n", err)
+				os.Exit(1)
+			}
+			tcpProxy := proxy.NewBalancedTcpProxy(parts[1], targets)
+			tcpProxy.Balancer.Strategy = balancingStrategy
+			tcpProxy.ProxyProtocol = proxy.ProxyProtocolVersion(*proxyProtocol)
+			tcpProxy.AcceptProxyProtocol = *acceptProxyProtocol
+			tcpProxy.RequireProxyProtocol = *requireProxyProtocol
+			tcpProxy.TlsConfig = tlsConfig
+			tcpProxy.TargetTlsConfig = targetTlsConfig
+			tcpProxy.SourceSocketOptions = sourceOptions
+			tcpProxy.TargetSocketOptions = targetOptions
+			tcpProxy.AccessLog = accessLog
+			tcpProxy.IdleTimeout = *tcpIdleTimeout
+			tcpProxy.FirstByteTimeout = *tcpFirstByteTimeout
+			tcpProxy.MaxLifetime = *tcpMaxLifetime
+			tcpProxy.MaxConnections = *tcpMaxConnections
+			tcpProxy.MaxConnectionsPerIP = *tcpMaxConnectionsPerIP
+			tcpProxy.AcceptQueueSize = *tcpAcceptQueueSize
+			tcpProxy.AcceptQueueTimeout = *tcpAcceptQueueTimeout
+			tcpProxy.DialTimeout = *tcpDialTimeout
+			tcpProxy.DialRetries = *tcpDialRetries
+			tcpProxy.DialBackoff = *tcpDialBackoff
+			tcpProxy.DialMaxBackoff = *tcpDialMaxBackoff
+			if len(sniRoutes) > 0 {
+				tcpProxy.SniRouter, err = newRouter(sniRoutes, balancingStrategy)
+				if err != nil {
+					Fprintf("Invalid SNI route: %v\n", err)
+					os.Exit(1)
+				}
+				if tcpProxy.SniRouter.Default == nil {
+					tcpProxy.SniRouter.Default = tcpProxy.Balancer
+				}
+			}
+			if len(sniffRoutes) > 0 {
+				tcpProxy.ProtocolRouter, err = newRouter(sniffRoutes, balancingStrategy)
+				if err == nil {
+					tcpProxy.Sniffer, err = newSniffer(sniffRegexps, *sniffTimeout)
+				}
+				if err != nil {
+					Fprintf("Invalid protocol route: %v\n", err)
+					os.Exit(1)
+				}
+				if tcpProxy.ProtocolRouter.Default == nil {
+					tcpProxy.ProtocolRouter.Default = tcpProxy.Balancer
+				}
+			}
+			if *healthInterval > 0 {
+				tcpProxy.HealthChecker = newHealthChecker("tcp", tcpProxy.Balancer)
+			}
 			p = tcpProxy
+		case "http":
+			targets, err := proxy.ParseTargets(parts[2])
+			if err != nil {
+				Fprintf("Invalid targets: %v\n", err)
+				os.Exit(1)
+			}
+			httpProxy := proxy.NewHttpProxy(parts[1], targets)
+			httpProxy.Balancer.Strategy = balancingStrategy
+			httpProxy.SourceSocketOptions = sourceOptions
+			httpProxy.TargetSocketOptions = targetOptions
+			if err := addHttpRoutes(httpProxy, httpRoutes, balancingStrategy); err != nil {
+				Fprintf("Invalid http route: %v\n", err)
+				os.Exit(1)
+			}
+			p = httpProxy
+		case "socks5":
+			socksProxy := proxy.NewSocks5Proxy(parts[1])
+			socksProxy.Users = users
+			socksProxy.Rules = rules
+			socksProxy.SourceSocketOptions = sourceOptions
+			socksProxy.TargetSocketOptions = targetOptions
+			p = socksProxy
+		case "connect":
+			connectProxy := proxy.NewConnectProxy(parts[1])
+			connectProxy.Users = users
+			connectProxy.Rules = rules
+			connectProxy.SourceSocketOptions = sourceOptions
+			connectProxy.TargetSocketOptions = targetOptions
+			p = connectProxy
 		case "udp":
 			udpProxy := proxy.NewUdpProxy(parts[1], parts[2])
+			udpProxy.SourceSocketOptions = sourceOptions
+			udpProxy.TargetSocketOptions = targetOptions
+			udpProxy.IdleTimeout = *udpIdleTimeout
+			udpProxy.AccessLog = accessLog
+			if *healthInterval > 0 {
+				udpProxy.HealthChecker = newHealthChecker("udp", udpProxy.Balancer)
+			}
 			p = udpProxy
 		case "mc":
 			multicastProxy := proxy.NewMulticastProxy(parts[1], parts[2])
+			multicastProxy.SourceSocketOptions = sourceOptions
+			multicastProxy.TargetSocketOptions = targetOptions
 			p = multicastProxy
 		default:
 			Fprintf("Unknown protocol: %v", parts[0])
@@ -42,8 +269,8 @@ func main() {
 		}
 
 		proxies = append(proxies, p)
-		if len(parts) > 3 {
-			p.SetName(parts[3])
+		if len(parts) > nameIndex {
+			p.SetName(parts[nameIndex])
 		}
 		p.SetVerbose(*verbose)
 		p.Start()
@@ -52,15 +279,190 @@ func main() {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	<-signals
+	shutdown(proxies, *shutdownGracePeriod, signals)
+	if accessLog != nil {
+		if err := accessLog.Close(); err != nil {
+			log.Printf("Could not close access log: %v", err)
+		}
+	}
+}
+
+// shutdown drains all proxies in parallel within the grace period. Another signal ends the grace period early.
+func shutdown(proxies []proxy.Proxy, gracePeriod time.Duration, signals <-chan os.Signal) {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var drained, killed int
 	for _, p := range proxies {
-		p.Stop()
+		wg.Add(1)
+		go func(p proxy.Proxy) {
+			defer wg.Done()
+			d, k := p.Shutdown(ctx)
+			mutex.Lock()
+			drained += d
+			killed += k
+			mutex.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	log.Printf("Shut down with %d drained and %d killed sessions", drained, killed)
+}
+
+// routeFlags collects repeated name=targets flags
+type routeFlags []string
+
+func (r *routeFlags) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *routeFlags) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func newRouter(routes []string, strategy proxy.BalancingStrategy) (*proxy.Router, error) {
+	router := proxy.NewRouter()
+	for _, route := range routes {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected name=targets: %v", route)
+		}
+		targets, err := proxy.ParseTargets(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		balancer := proxy.NewBalancer(targets)
+		balancer.Strategy = strategy
+		router.Add(parts[0], balancer)
+	}
+	return router, nil
+}
+
+func addHttpRoutes(httpProxy *proxy.HttpProxy, routes []string, strategy proxy.BalancingStrategy) error {
+	for _, route := range routes {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected host/path=targets: %v", route)
+		}
+		host, path := parts[0], "/"
+		if i := strings.Index(parts[0], "/"); i >= 0 {
+			host, path = parts[0][:i], parts[0][i:]
+		}
+		targets, err := proxy.ParseTargets(parts[1])
+		if err != nil {
+			return err
+		}
+		balancer := proxy.NewBalancer(targets)
+		balancer.Strategy = strategy
+		httpProxy.AddRoute(host, path, balancer)
+	}
+	return nil
+}
+
+func parseUsers(specs []string) (map[string]string, error) {
+	users := map[string]string{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected user:password: %v", spec)
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, nil
+}
+
+func parseDestinationRules(specs []string) ([]*proxy.DestinationRule, error) {
+	var rules []*proxy.DestinationRule
+	for _, spec := range specs {
+		rule, err := proxy.ParseDestinationRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// openAccessLog returns nil for an empty path and writes to stdout for -
+func openAccessLog(path string) (*proxy.AccessLog, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return proxy.NewAccessLog(os.Stdout), nil
+	}
+	return proxy.OpenAccessLog(path)
+}
+
+// unescape replaces escape sequences like \r\n of a flag value
+func unescape(value string) ([]byte, error) {
+	unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(value, `"`, `\"`) + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid escape sequence in %q", value)
+	}
+	return []byte(unquoted), nil
+}
+
+// parseSocketOptions returns nil for an empty spec to keep the defaults
+func parseSocketOptions(spec string) (*proxy.SocketOptions, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	return proxy.ParseSocketOptions(spec)
+}
+
+func newSniffer(regexps []string, timeout time.Duration) (*proxy.Sniffer, error) {
+	sniffer := proxy.NewSniffer()
+	sniffer.Timeout = timeout
+	for _, spec := range regexps {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected name=regexp: %v", spec)
+		}
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		sniffer.AddRegexp(parts[0], re)
+	}
+	return sniffer, nil
+}
+
+func newTlsConfig(certFile, keyFile, minVersion, ciphers, alpn string) (*tls.Config, error) {
+	config, err := proxy.NewServerTlsConfig(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if config.MinVersion, err = proxy.ParseTlsVersion(minVersion); err != nil {
+		return nil, err
+	}
+	if ciphers != "" {
+		if config.CipherSuites, err = proxy.ParseCipherSuites(ciphers); err != nil {
+			return nil, err
+		}
+	}
+	if alpn != "" {
+		config.NextProtos = strings.Split(alpn, ",")
 	}
+	return config, nil
 }
 
 func Usage() {
-	Fprintf("Proxy either udp, tcp or multicast (mc)\n")
-	Fprintf("Usage: %s [options] [[tcp|udp|mc],sourceAddress,targetAddress[,name]]...\n", os.Args[0])
+	Fprintf("Proxy either udp, tcp, http, socks5, HTTP CONNECT (connect) or multicast (mc)\n")
+	Fprintf("Usage: %s [options] [[tcp|udp|http|mc],sourceAddress,targetAddress[,name]] [[socks5|connect],sourceAddress[,name]]...\n", os.Args[0])
 	Fprintf("Example: %s udp,:10000,localhost:10001,foo mc,224.0.0.1:10000,224.0.0.2:10000,bar\n", os.Args[0])
+	Fprintf("TCP and HTTP proxies accept multiple targets with optional weights: tcp,:8080,a:80*2|b:80\n")
+	Fprintf("TCP proxies accept Unix sockets as source and target, also in the abstract namespace: tcp,:2375,unix:/var/run/docker.sock\n")
+	Fprintf("IPv6 addresses are written in brackets, IPv6 multicast groups with the interface as zone: udp,[::]:10000,127.0.0.1:10001 mc,[ff02::1%%eth0]:10000,224.0.0.1:10000\n")
 	Fprintf("\n")
 	flag.PrintDefaults()
 }
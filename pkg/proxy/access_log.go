@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sides of a session, that closed it first
+const (
+	ClosedBySource = "source"
+	ClosedByTarget = "target"
+	ClosedByProxy  = "proxy"
+)
+
+// SessionRecord describes a finished session of a proxy
+type SessionRecord struct {
+	ID    string `json:"id"`
+	Proxy string `json:"proxy"`
+	// Network is either tcp or udp
+	Network string `json:"network"`
+	Source  string `json:"source"`
+	// SourceLocal is the address the source sent to
+	SourceLocal string `json:"source_local,omitempty"`
+	Target      string `json:"target"`
+	// TargetLocal is the address the proxy sent to the target from
+	TargetLocal     string    `json:"target_local,omitempty"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	BytesFromSource int64     `json:"bytes_from_source"`
+	BytesFromTarget int64     `json:"bytes_from_target"`
+	// PacketsFromSource and PacketsFromTarget count the datagrams of UDP sessions
+	PacketsFromSource int64  `json:"packets_from_source,omitempty"`
+	PacketsFromTarget int64  `json:"packets_from_target,omitempty"`
+	CloseReason       string `json:"close_reason"`
+	// ClosedBy is the side that closed the session first: ClosedBySource, ClosedByTarget or ClosedByProxy
+	ClosedBy string `json:"closed_by"`
+}
+
+// newSessionRecord starts a record with a random ID
+func newSessionRecord(proxy, network string) *SessionRecord {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("%v - Could not create session ID: %v", proxy, err)
+	}
+	return &SessionRecord{ID: hex.EncodeToString(id), Proxy: proxy, Network: network, Start: time.Now()}
+}
+
+// AccessLog writes a SessionRecord per line as JSON
+type AccessLog struct {
+	writer io.Writer
+	closer io.Closer
+	mutex  sync.Mutex
+}
+
+// NewAccessLog creates an access log that writes to w, like os.Stdout
+func NewAccessLog(w io.Writer) *AccessLog {
+	return &AccessLog{writer: w}
+}
+
+// OpenAccessLog creates an access log that appends to the file at path
+func OpenAccessLog(path string) (*AccessLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLog{writer: file, closer: file}, nil
+}
+
+// Log writes the record. A nil access log discards it.
+func (l *AccessLog) Log(record *SessionRecord) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("%v - Could not encode session %v: %v", record.Proxy, record.ID, err)
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.writer.Write(append(line, '\n')); err != nil {
+		log.Printf("%v - Could not write session %v to the access log: %v", record.Proxy, record.ID, err)
+	}
+}
+
+// Close closes the file of the access log, if it was opened with OpenAccessLog
+func (l *AccessLog) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
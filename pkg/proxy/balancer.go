@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BalancingStrategy defines how a target is chosen for a new connection
+type BalancingStrategy int
+
+const (
+	// RoundRobin chooses the targets one after another, according to their weights
+	RoundRobin BalancingStrategy = iota
+	// Random chooses a random target, according to their weights
+	Random
+	// LeastConnections chooses the target with the fewest active connections relative to its weight
+	LeastConnections
+	// SourceIPHash chooses the target based on the IP of the source, so that a source always gets the same target
+	SourceIPHash
+)
+
+var balancingStrategyNames = map[string]BalancingStrategy{
+	"roundrobin": RoundRobin,
+	"random":     Random,
+	"leastconn":  LeastConnections,
+	"sourcehash": SourceIPHash,
+}
+
+// ParseBalancingStrategy parses one of: roundrobin, random, leastconn, sourcehash
+func ParseBalancingStrategy(name string) (BalancingStrategy, error) {
+	if strategy, ok := balancingStrategyNames[name]; ok {
+		return strategy, nil
+	}
+	return RoundRobin, fmt.Errorf("unknown balancing strategy: %v", name)
+}
+
+// Target is an upstream address with a weight for load balancing
+type Target struct {
+	Address string
+	Weight  int
+	// active is the number of active connections
+	active int
+	// unhealthy targets are excluded from the selection
+	unhealthy bool
+	// failures is the number of consecutive failures reported for the target
+	failures int
+	// openUntil is set while the circuit breaker is open. After it passed, a single trial connection is allowed.
+	openUntil time.Time
+	// trial is true while the trial connection of a half-open circuit breaker is active
+	trial bool
+	// currentWeight is used for smooth weighted round robin
+	currentWeight int
+}
+
+// NewTarget creates a new target with a weight of 1
+func NewTarget(address string) *Target {
+	return &Target{Address: address, Weight: 1}
+}
+
+// ParseTargets parses a list of targets, separated by '|'.
+// Each target can have a weight, separated by '*', for example: a:80*2|b:80
+func ParseTargets(spec string) (targets []*Target, err error) {
+	for _, part := range strings.Split(spec, "|") {
+		target := NewTarget(part)
+		if i := strings.LastIndex(part, "*"); i >= 0 {
+			target.Address = part[:i]
+			target.Weight, err = strconv.Atoi(part[i+1:])
+			if err != nil || target.Weight < 1 {
+				return nil, fmt.Errorf("invalid weight in target %v", part)
+			}
+		}
+		if target.Address == "" {
+			return nil, fmt.Errorf("empty target address in %v", spec)
+		}
+		targets = append(targets, target)
+	}
+	return
+}
+
+// Balancer chooses a target for new connections
+type Balancer struct {
+	Strategy BalancingStrategy
+	// FailureThreshold is the number of consecutive failures of a target that trips its circuit breaker.
+	// Zero disables the circuit breaker.
+	FailureThreshold int
+	// CoolDown is the time a tripped target is excluded from the selection before a trial connection is allowed
+	CoolDown time.Duration
+	targets  []*Target
+	mutex    sync.Mutex
+}
+
+// NewBalancer creates a new round robin balancer for the given targets.
+// Targets with a weight below 1 get a weight of 1.
+func NewBalancer(targets []*Target) *Balancer {
+	for _, target := range targets {
+		if target.Weight < 1 {
+			target.Weight = 1
+		}
+	}
+	return &Balancer{
+		Strategy:         RoundRobin,
+		FailureThreshold: 5,
+		CoolDown:         10 * time.Second,
+		targets:          targets,
+	}
+}
+
+// Targets returns a copy of the list of targets. The targets themselves are shared and must not be modified.
+func (b *Balancer) Targets() []*Target {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]*Target{}, b.targets...)
+}
+
+// Acquire chooses a target for a new connection from the given source address.
+// trial is true for the trial connection of a half-open circuit breaker.
+// The target must be released with Release and the same trial flag, when the connection is closed.
+func (b *Balancer) Acquire(sourceAddr net.Addr) (target *Target, trial bool, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	candidates := b.available()
+	if len(candidates) == 0 {
+		return nil, false, false
+	}
+
+	switch b.Strategy {
+	case Random:
+		target = weighted(candidates, rand.Intn(totalWeight(candidates)))
+	case LeastConnections:
+		target = leastConnections(candidates)
+	case SourceIPHash:
+		target = weighted(candidates, int(hashIP(sourceAddr)%uint32(totalWeight(candidates))))
+	default:
+		target = roundRobin(candidates)
+	}
+	target.active++
+	if !target.openUntil.IsZero() {
+		target.trial = true
+		trial = true
+	}
+	return target, trial, true
+}
+
+// available returns all targets that can be selected. The mutex must be locked.
+func (b *Balancer) available() (candidates []*Target) {
+	now := time.Now()
+	for _, target := range b.targets {
+		if target.unhealthy {
+			continue
+		}
+		if !target.openUntil.IsZero() && (now.Before(target.openUntil) || target.trial) {
+			continue
+		}
+		candidates = append(candidates, target)
+	}
+	return
+}
+
+// ReportFailure records a failed connection to the target.
+// It returns true, if the circuit breaker of the target was tripped.
+func (b *Balancer) ReportFailure(target *Target) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.FailureThreshold <= 0 {
+		return false
+	}
+	target.failures++
+	if target.trial || target.failures >= b.FailureThreshold {
+		target.failures = 0
+		target.openUntil = time.Now().Add(b.CoolDown)
+		target.trial = false
+		return true
+	}
+	return false
+}
+
+// ReportSuccess records a successful connection to the target.
+// It returns true, if the circuit breaker of the target was closed again.
+func (b *Balancer) ReportSuccess(target *Target) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	target.failures = 0
+	if target.openUntil.IsZero() {
+		return false
+	}
+	target.openUntil = time.Time{}
+	target.trial = false
+	return true
+}
+
+// IsOpen returns true, if the circuit breaker of the target is tripped
+func (b *Balancer) IsOpen(target *Target) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !target.openUntil.IsZero()
+}
+
+// SetHealthy includes or excludes the target from the selection
+func (b *Balancer) SetHealthy(target *Target, healthy bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	target.unhealthy = !healthy
+}
+
+// IsHealthy returns true, if the target can be selected
+func (b *Balancer) IsHealthy(target *Target) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !target.unhealthy
+}
+
+// Release a target that was acquired for a connection. trial is the flag returned by Acquire.
+func (b *Balancer) Release(target *Target, trial bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	target.active--
+	if trial {
+		// a trial without a reported result allows another trial, other connections must not end the trial
+		target.trial = false
+	}
+}
+
+// ActiveConnections returns the number of active connections of the target
+func (b *Balancer) ActiveConnections(target *Target) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return target.active
+}
+
+func totalWeight(targets []*Target) (total int) {
+	for _, target := range targets {
+		total += target.Weight
+	}
+	return
+}
+
+// weighted returns the target that covers the given position within the total weight
+func weighted(targets []*Target, pos int) *Target {
+	for _, target := range targets {
+		if pos < target.Weight {
+			return target
+		}
+		pos -= target.Weight
+	}
+	return targets[len(targets)-1]
+}
+
+// roundRobin implements the smooth weighted round robin algorithm
+func roundRobin(targets []*Target) (best *Target) {
+	total := 0
+	for _, target := range targets {
+		target.currentWeight += target.Weight
+		total += target.Weight
+		if best == nil || target.currentWeight > best.currentWeight {
+			best = target
+		}
+	}
+	best.currentWeight -= total
+	return
+}
+
+func leastConnections(targets []*Target) (best *Target) {
+	for _, target := range targets {
+		// compare active/weight without divisions
+		if best == nil || target.active*best.Weight < best.active*target.Weight {
+			best = target
+		}
+	}
+	return
+}
+
+// hashIP hashes the IP of the address. All sources without an address share the same hash.
+func hashIP(addr net.Addr) uint32 {
+	host := ""
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && tcpAddr != nil {
+		host = tcpAddr.IP.String()
+	} else if udpAddr, ok := addr.(*net.UDPAddr); ok && udpAddr != nil {
+		host = udpAddr.IP.String()
+	} else if addr != nil {
+		host = addr.String()
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(host))
+	return h.Sum32()
+}
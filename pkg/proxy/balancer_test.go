@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBalancer_single_trial(t *testing.T) {
+	balancer := NewBalancer([]*Target{NewTarget("localhost:1")})
+	balancer.FailureThreshold = 1
+	balancer.CoolDown = 10 * time.Millisecond
+
+	// a connection that was opened before the circuit breaker tripped
+	target, trial, ok := balancer.Acquire(&net.TCPAddr{})
+	if !ok || trial {
+		t.Fatalf("Expected a regular connection, but got %v and trial %v", ok, trial)
+	}
+	balancer.ReportFailure(target)
+	time.Sleep(20 * time.Millisecond)
+
+	_, trial, ok = balancer.Acquire(&net.TCPAddr{})
+	if !ok || !trial {
+		t.Fatalf("Expected a trial connection after the cool-down, but got %v and trial %v", ok, trial)
+	}
+	balancer.Release(target, false)
+	if _, _, ok := balancer.Acquire(&net.TCPAddr{}); ok {
+		t.Error("Expected no second trial, while the first one is active")
+	}
+	balancer.Release(target, true)
+	if _, trial, ok := balancer.Acquire(&net.TCPAddr{}); !ok || !trial {
+		t.Errorf("Expected another trial after the first one ended without a result, but got %v and trial %v", ok, trial)
+	}
+}
+
+func TestBalancer_zero_weights(t *testing.T) {
+	for name, strategy := range balancingStrategyNames {
+		t.Run(name, func(t *testing.T) {
+			balancer := NewBalancer([]*Target{{Address: "a:80"}, {Address: "b:80", Weight: -1}})
+			balancer.Strategy = strategy
+			chosen := map[string]bool{}
+			for i := 0; i < 50; i++ {
+				sourceAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, byte(i))}
+				target, trial, ok := balancer.Acquire(sourceAddr)
+				if !ok || trial {
+					t.Fatalf("Expected a target, but got %v and trial %v", ok, trial)
+				}
+				chosen[target.Address] = true
+				if strategy != LeastConnections {
+					balancer.Release(target, trial)
+				}
+			}
+			if !chosen["a:80"] || !chosen["b:80"] {
+				t.Errorf("Expected both targets to be chosen with a weight of 1, but got %v", chosen)
+			}
+		})
+	}
+}
+
+func TestBalancer_without_source_address(t *testing.T) {
+	balancer := NewBalancer([]*Target{NewTarget("a:80"), NewTarget("b:80")})
+	balancer.Strategy = SourceIPHash
+	first, _, ok := balancer.Acquire(nil)
+	if !ok {
+		t.Fatal("Expected a target without a source address")
+	}
+	if second, _, _ := balancer.Acquire(nil); second != first {
+		t.Errorf("Expected the same target for all sources without an address, but got %v and %v", first.Address, second.Address)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build go1.16
+// +build go1.16
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// isClosedConnError checks if the error was caused by using an already closed connection
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
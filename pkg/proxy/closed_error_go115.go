@@ -0,0 +1,12 @@
+//go:build !go1.16
+// +build !go1.16
+
+package proxy
+
+import "strings"
+
+// isClosedConnError checks if the error was caused by using an already closed connection.
+// net.ErrClosed was added in Go 1.16, so older versions, which go.mod still allows, can only match the message.
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
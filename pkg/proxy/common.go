@@ -1,18 +1,56 @@
 package proxy
 
 import (
+	"context"
 	"log"
+	"net"
 	"sync"
 	"time"
 )
 
 const maxDatagramSize = 8192
 
+// OverflowPolicy defines how to deal with data that does not fit into a full buffer
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the sender until there is enough space in the buffer
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop drops the data that does not fit into the buffer
+	OverflowDrop
+	// OverflowDisconnect closes the connection of the sender
+	OverflowDisconnect
+)
+
+// StreamConn is a stream connection that can close its write direction, like *net.TCPConn and *tls.Conn
+type StreamConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// prefixConn returns the prefix before reading from the connection
+type prefixConn struct {
+	StreamConn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.StreamConn.Read(b)
+}
+
 type Proxy interface {
 	SetName(name string)
 	SetVerbose(verbose bool)
 	Start()
 	Stop()
+	// Shutdown stops accepting new sessions and waits for the existing ones to finish, until the context is done.
+	// The remaining sessions are closed then. It returns the number of finished and closed sessions.
+	Shutdown(ctx context.Context) (drained, killed int)
 }
 
 type StatsPrinter struct {
@@ -40,3 +78,55 @@ func (s *StatsPrinter) NewMessage(classifier string) {
 		s.numMessages = map[string]int{}
 	}
 }
+
+// drainAndStop waits for the connections of the server to finish, until the context is done, and stops the proxy then
+func drainAndStop(ctx context.Context, name string, server *TcpServer, stop func()) (drained, killed int) {
+	drained, killed = server.Drain(ctx)
+	stop()
+	log.Printf("%v - Shut down with %d drained and %d killed sessions", name, drained, killed)
+	return
+}
+
+// relayClients tracks the clients of a proxy that relay to destinations requested by their sources,
+// so that pending connection attempts can be canceled on stop
+type relayClients struct {
+	clients map[*TcpClient]bool
+	running bool
+	mutex   sync.Mutex
+}
+
+func (r *relayClients) start() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clients = map[*TcpClient]bool{}
+	r.running = true
+}
+
+// stop rejects new clients and stops all current clients
+func (r *relayClients) stop() {
+	r.mutex.Lock()
+	clients := r.clients
+	r.clients = nil
+	r.running = false
+	r.mutex.Unlock()
+	for client := range clients {
+		client.Stop()
+	}
+}
+
+// add registers the client and returns false, if the proxy is not running
+func (r *relayClients) add(client *TcpClient) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.running {
+		return false
+	}
+	r.clients[client] = true
+	return true
+}
+
+func (r *relayClients) remove(client *TcpClient) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.clients, client)
+}
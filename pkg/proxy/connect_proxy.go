@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ConnectProxy is an HTTP proxy that only supports CONNECT requests. After a successful request,
+// the data is relayed between the client and the requested destination like with a TcpProxy.
+type ConnectProxy struct {
+	name string
+	// Users requires clients to authenticate with Basic proxy authentication with one of these usernames
+	// and passwords, if not empty
+	Users map[string]string
+	// Rules restrict the allowed destinations. The first matching rule decides, destinations without
+	// a matching rule are denied. Without rules, all destinations are allowed.
+	// Domain names are resolved before the rules are checked and the resolved IP is used for connecting.
+	Rules []*DestinationRule
+	// HandshakeTimeout is the maximum time for receiving the request of a client
+	HandshakeTimeout time.Duration
+	// DialTimeout is the timeout for resolving and connecting to a destination
+	DialTimeout time.Duration
+	// SourceSocketOptions tune the sockets of the clients, if set
+	SourceSocketOptions *SocketOptions
+	// TargetSocketOptions tune the sockets to the destinations, if set
+	TargetSocketOptions *SocketOptions
+	server              *TcpServer
+	clients             relayClients
+	verbose             bool
+	statsPrinter        *StatsPrinter
+	Proxy
+}
+
+// NewConnectProxy creates a new HTTP CONNECT proxy with:
+// sourceAddress: The address to listen on
+func NewConnectProxy(sourceAddress string) (p *ConnectProxy) {
+	p = new(ConnectProxy)
+	p.server = NewTcpServer(sourceAddress)
+	p.server.Handler = p.handle
+	p.server.CbRejected = p.sourceRejected
+	p.HandshakeTimeout = 10 * time.Second
+	p.DialTimeout = 10 * time.Second
+	p.statsPrinter = NewStatsPrinter()
+	p.SetName("ConnectProxy")
+	return
+}
+
+// SetName sets the name of the proxy for identification in logs
+func (p *ConnectProxy) SetName(name string) {
+	p.name = name
+	p.server.Name = name + "_Server"
+}
+
+// SetVerbose enables logging of every request
+func (p *ConnectProxy) SetVerbose(verbose bool) {
+	p.verbose = verbose
+}
+
+// Start listening for clients
+func (p *ConnectProxy) Start() {
+	p.clients.start()
+	p.server.SocketOptions = p.SourceSocketOptions
+	p.server.Start()
+}
+
+// Stop listening and close all connections
+func (p *ConnectProxy) Stop() {
+	// cancel pending connection attempts, so that the server does not wait for them
+	p.clients.stop()
+	p.server.Stop()
+}
+
+// Shutdown stops accepting new clients and waits for the existing connections to finish, until the context is done.
+// The remaining ones are closed then. It returns the number of finished and closed connections.
+func (p *ConnectProxy) Shutdown(ctx context.Context) (drained, killed int) {
+	return drainAndStop(ctx, p.name, p.server, p.Stop)
+}
+
+func (p *ConnectProxy) sourceRejected(net.Addr, string) {
+	p.statsPrinter.NewMessage(p.name + ":rejected")
+}
+
+// handle reads the CONNECT request of a client and relays the connection to the destination
+func (p *ConnectProxy) handle(conn StreamConn, addr net.Addr, _ []byte) {
+	if p.HandshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(p.HandshakeTimeout)); err != nil {
+			log.Printf("%v - Could not set handshake deadline for %v: %v", p.name, addr, err)
+			return
+		}
+	}
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Printf("%v - Could not read request of %v: %v", p.name, addr, err)
+			p.respond(conn, addr, http.StatusBadRequest, nil)
+		}
+		return
+	}
+	if req.Method != http.MethodConnect {
+		log.Printf("%v - Unsupported method %v of %v", p.name, req.Method, addr)
+		p.respond(conn, addr, http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return
+	}
+	user, ok := p.authenticate(req)
+	if !ok {
+		log.Printf("%v - Rejected %v: missing or invalid credentials", p.name, addr)
+		p.statsPrinter.NewMessage(p.name + ":rejected")
+		p.respond(conn, addr, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`}})
+		return
+	}
+	host, portString, err := net.SplitHostPort(req.Host)
+	port, portErr := strconv.Atoi(portString)
+	if err != nil || portErr != nil || port < 1 || port > 65535 {
+		log.Printf("%v - Invalid destination %q of %v", p.name, req.Host, addr)
+		p.respond(conn, addr, http.StatusBadRequest, nil)
+		return
+	}
+	if p.verbose {
+		log.Printf("%v - CONNECT of %v (user %q) to %v", p.name, addr, user, req.Host)
+	}
+
+	target, err := resolveDestination(host, port, p.Rules, p.DialTimeout)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errDestinationNotAllowed) {
+			status = http.StatusForbidden
+		}
+		log.Printf("%v - Rejected %v for %v: %v", p.name, addr, req.Host, err)
+		p.statsPrinter.NewMessage(p.name + ":rejected")
+		p.respond(conn, addr, status, nil)
+		return
+	}
+
+	// the client may already have sent data after the request
+	prefix, _ := reader.Peek(reader.Buffered())
+	client := NewTcpClient(target)
+	client.Name = p.name + "_Client"
+	client.Verbose = p.verbose
+	client.HalfClose = true
+	client.DialTimeout = p.DialTimeout
+	client.SocketOptions = p.TargetSocketOptions
+	client.CbConnected = func() {
+		if !p.respond(conn, addr, http.StatusOK, nil) {
+			// aborts the relaying
+			_ = conn.Close()
+		}
+	}
+	client.CbConnectFailed = func(err error) {
+		log.Printf("%v - Could not connect %v to %v: %v", p.name, addr, req.Host, err)
+		status := http.StatusBadGateway
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			status = http.StatusGatewayTimeout
+		}
+		p.respond(conn, addr, status, nil)
+	}
+	if !p.clients.add(client) {
+		return
+	}
+	defer p.clients.remove(client)
+	client.Relay(conn, prefix)
+}
+
+// authenticate checks the Basic credentials of the Proxy-Authorization header and returns the username
+func (p *ConnectProxy) authenticate(req *http.Request) (string, bool) {
+	if len(p.Users) == 0 {
+		return "", true
+	}
+	// BasicAuth parses the Authorization header, which has the same format
+	credentials := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	user, password, ok := credentials.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, ok := p.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		return "", false
+	}
+	return user, true
+}
+
+// respond sends a response without a body to the client and clears the handshake deadline on success.
+// All responses except for a successful CONNECT close the connection.
+func (p *ConnectProxy) respond(conn StreamConn, addr net.Addr, status int, header http.Header) bool {
+	if header == nil {
+		header = http.Header{}
+	}
+	if status != http.StatusOK {
+		header.Set("Content-Length", "0")
+		header.Set("Connection", "close")
+	}
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	_ = header.Write(&buf)
+	buf.WriteString("\r\n")
+	_, err := conn.Write(buf.Bytes())
+	if err == nil && status == http.StatusOK {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		log.Printf("%v - Could not respond to %v: %v", p.name, addr, err)
+		return false
+	}
+	return true
+}
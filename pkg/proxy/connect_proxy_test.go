@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// connectRequest sends a CONNECT request and returns the response and a reader for the relayed data
+func connectRequest(t *testing.T, conn net.Conn, request string) (*http.Response, *bufio.Reader) {
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, reader
+}
+
+func TestConnectProxy_connect(t *testing.T) {
+	server := newSocksTestEchoServer(":18901")
+	defer server.Stop()
+
+	proxy := NewConnectProxy("localhost:18900")
+	proxy.SetName("ConnectTestProxy")
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn, err := net.Dial("tcp", "localhost:18900")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	// data directly after the request has to be relayed as well
+	res, reader := connectRequest(t, conn, "CONNECT localhost:18901 HTTP/1.1\r\nHost: localhost:18901\r\n\r\nEarly")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %v", res.Status)
+	}
+	if _, err := io.WriteString(conn, " data"); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, len("Early data"))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Early data" {
+		t.Errorf("Expected 'Early data', but got '%s'", data)
+	}
+}
+
+func TestConnectProxy_rejections(t *testing.T) {
+	server := newSocksTestEchoServer(":19001")
+	defer server.Stop()
+
+	proxy := NewConnectProxy("localhost:19000")
+	proxy.SetName("ConnectTestProxy")
+	proxy.Users = map[string]string{"alice": "secret"}
+	rule, err := ParseDestinationRule("allow 127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Rules = []*DestinationRule{rule}
+	proxy.Start()
+	defer proxy.Stop()
+
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n"
+	wrongAuth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong")) + "\r\n"
+	tests := []struct {
+		name     string
+		request  string
+		expected int
+	}{
+		{"Valid", "CONNECT 127.0.0.1:19001 HTTP/1.1\r\nHost: 127.0.0.1:19001\r\n" + auth + "\r\n", http.StatusOK},
+		{"No credentials", "CONNECT 127.0.0.1:19001 HTTP/1.1\r\nHost: 127.0.0.1:19001\r\n\r\n", http.StatusProxyAuthRequired},
+		{"Wrong password", "CONNECT 127.0.0.1:19001 HTTP/1.1\r\nHost: 127.0.0.1:19001\r\n" + wrongAuth + "\r\n", http.StatusProxyAuthRequired},
+		{"Not allowed", "CONNECT 127.0.0.2:19001 HTTP/1.1\r\nHost: 127.0.0.2:19001\r\n" + auth + "\r\n", http.StatusForbidden},
+		{"Refused", "CONNECT 127.0.0.1:19002 HTTP/1.1\r\nHost: 127.0.0.1:19002\r\n" + auth + "\r\n", http.StatusBadGateway},
+		{"Missing port", "CONNECT 127.0.0.1 HTTP/1.1\r\nHost: 127.0.0.1\r\n" + auth + "\r\n", http.StatusBadRequest},
+		{"Other method", "GET http://127.0.0.1:19001/ HTTP/1.1\r\nHost: 127.0.0.1:19001\r\n" + auth + "\r\n", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", "localhost:19000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+			res, _ := connectRequest(t, conn, test.request)
+			if res.StatusCode != test.expected {
+				t.Fatalf("Expected status %v, but got %v", test.expected, res.Status)
+			}
+			if res.StatusCode == http.StatusProxyAuthRequired && res.Header.Get("Proxy-Authenticate") == "" {
+				t.Error("Expected a Proxy-Authenticate header")
+			}
+			if res.StatusCode == http.StatusOK {
+				socksEcho(t, conn, "Hello")
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errDestinationNotAllowed = errors.New("destination not allowed")
+
+// DestinationRule allows or denies destinations that clients request from a proxy, like with SOCKS or HTTP CONNECT
+type DestinationRule struct {
+	Allow bool
+	// Host is a domain name, a wildcard like *.example.com, an IP, a CIDR like 10.0.0.0/8 or * for all destinations
+	Host string
+	// Port restricts the rule to a single port, if greater than zero
+	Port int
+}
+
+// ParseDestinationRule parses a rule like "allow 10.0.0.0/8", "deny *.example.com:25" or "allow [::1]:80"
+func ParseDestinationRule(spec string) (*DestinationRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+		return nil, fmt.Errorf("expected 'allow|deny host[:port]': %v", spec)
+	}
+	rule := &DestinationRule{Allow: fields[0] == "allow", Host: fields[1]}
+	if host, port, err := net.SplitHostPort(fields[1]); err == nil {
+		rule.Host = host
+		if port != "*" {
+			if rule.Port, err = strconv.Atoi(port); err != nil || rule.Port < 1 || rule.Port > 65535 {
+				return nil, fmt.Errorf("invalid port in destination rule: %v", spec)
+			}
+		}
+	}
+	return rule, nil
+}
+
+// matches checks the rule against the requested name, which is empty for IP destinations, the IP and the port
+func (r *DestinationRule) matches(name string, ip net.IP, port int) bool {
+	if r.Port > 0 && r.Port != port {
+		return false
+	}
+	if r.Host == "*" {
+		return true
+	}
+	if _, network, err := net.ParseCIDR(r.Host); err == nil {
+		return network.Contains(ip)
+	}
+	if ruleIP := net.ParseIP(r.Host); ruleIP != nil {
+		return ruleIP.Equal(ip)
+	}
+	if strings.HasPrefix(r.Host, "*.") {
+		return strings.HasSuffix(strings.ToLower(name), strings.ToLower(r.Host[1:]))
+	}
+	return strings.EqualFold(r.Host, name)
+}
+
+// destinationAllowed applies the rules to a destination. The first matching rule decides and destinations
+// without a matching rule are denied. Without rules, all destinations are allowed.
+func destinationAllowed(rules []*DestinationRule, name string, ip net.IP, port int) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, rule := range rules {
+		if rule.matches(name, ip, port) {
+			return rule.Allow
+		}
+	}
+	return false
+}
+
+// resolveDestination resolves the host, if it is a domain name, checks the destination against the rules
+// and returns the address to connect to. The resolved IP is used for connecting, so that the checked IP
+// can not change with another lookup.
+func resolveDestination(host string, port int, rules []*DestinationRule, timeout time.Duration) (string, error) {
+	name, ip := "", net.ParseIP(host)
+	if ip == nil {
+		name = host
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		if len(addrs) == 0 {
+			return "", fmt.Errorf("no address found for %v", name)
+		}
+		// prefer IPv4, as many hosts have no IPv6 route
+		ip = addrs[0].IP
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				ip = addr.IP
+				break
+			}
+		}
+	}
+	if !destinationAllowed(rules, name, ip, port) {
+		return "", errDestinationNotAllowed
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
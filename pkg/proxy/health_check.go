@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// HealthChecker checks all targets of its balancers periodically and excludes unhealthy targets from the selection.
+// For TCP, a target is healthy if a connection can be established and, if Send is set,
+// the response starts with Expect. For UDP, Send is sent and the response must start with Expect.
+type HealthChecker struct {
+	Name string
+	// Network is either "tcp" or "udp"
+	Network string
+	// Interval between two checks of a target
+	Interval time.Duration
+	// Timeout for a single check
+	Timeout time.Duration
+	// Send is the payload that is sent to the target
+	Send []byte
+	// Expect is the expected prefix of the response of the target
+	Expect []byte
+	// HealthyThreshold is the number of consecutive successful checks to mark a target healthy again
+	HealthyThreshold int
+	// UnhealthyThreshold is the number of consecutive failed checks to mark a target unhealthy
+	UnhealthyThreshold int
+	// ProxyProtocol sends a PROXY protocol header with the LOCAL command to TCP targets, which require a header
+	ProxyProtocol ProxyProtocolVersion
+	// TlsConfig connects to TCP targets with TLS, if set, so that a target is only healthy, if the handshake succeeds
+	TlsConfig *tls.Config
+	balancers []*Balancer
+	running   bool
+	stopped   chan struct{}
+	mutex     sync.Mutex
+	checkers  sync.WaitGroup
+}
+
+// NewHealthChecker creates a new health checker for the targets of the balancer
+func NewHealthChecker(network string, balancer *Balancer) (h *HealthChecker) {
+	h = new(HealthChecker)
+	h.Name = "HealthChecker"
+	h.Network = network
+	h.Interval = 5 * time.Second
+	h.Timeout = 1 * time.Second
+	h.HealthyThreshold = 2
+	h.UnhealthyThreshold = 2
+	h.balancers = []*Balancer{balancer}
+	return
+}
+
+// AddBalancer checks the targets of another balancer, like the balancers of the routes of a Router.
+// It must be called before Start. Balancers that were already added are ignored.
+func (h *HealthChecker) AddBalancer(balancer *Balancer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, b := range h.balancers {
+		if b == balancer {
+			return
+		}
+	}
+	h.balancers = append(h.balancers, balancer)
+}
+
+// Start checking all targets in separate goroutines
+func (h *HealthChecker) Start() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.running {
+		return
+	}
+	h.running = true
+	h.stopped = make(chan struct{})
+
+	for _, balancer := range h.balancers {
+		for _, target := range balancer.Targets() {
+			h.checkers.Add(1)
+			go h.watch(balancer, target)
+		}
+	}
+}
+
+// Stop checking the targets
+func (h *HealthChecker) Stop() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.running {
+		return
+	}
+	h.running = false
+	close(h.stopped)
+	h.checkers.Wait()
+}
+
+// IsHealthy returns the current health state of the target. Unknown targets are healthy.
+func (h *HealthChecker) IsHealthy(target *Target) bool {
+	h.mutex.Lock()
+	balancers := h.balancers
+	h.mutex.Unlock()
+	for _, balancer := range balancers {
+		for _, t := range balancer.Targets() {
+			if t == target {
+				return balancer.IsHealthy(target)
+			}
+		}
+	}
+	return true
+}
+
+func (h *HealthChecker) watch(balancer *Balancer, target *Target) {
+	defer h.checkers.Done()
+
+	var udpCheck *udpHealthCheck
+	if h.Network == "udp" {
+		udpCheck = newUdpHealthCheck(h.Name, target.Address)
+		defer udpCheck.stop()
+	}
+
+	successes := 0
+	failures := 0
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		if udpCheck != nil {
+			err = udpCheck.check(h.Send, h.Expect, h.Timeout)
+		} else {
+			err = h.checkTcp(target.Address)
+		}
+
+		healthy := balancer.IsHealthy(target)
+		if err == nil {
+			successes++
+			failures = 0
+			if !healthy && successes >= h.HealthyThreshold {
+				log.Printf("%v - Target %v is healthy again after %d successful checks", h.Name, target.Address, successes)
+				balancer.SetHealthy(target, true)
+			}
+		} else {
+			failures++
+			successes = 0
+			if healthy && failures >= h.UnhealthyThreshold {
+				log.Printf("%v - Target %v is unhealthy after %d failed checks: %v", h.Name, target.Address, failures, err)
+				balancer.SetHealthy(target, false)
+			}
+		}
+
+		select {
+		case <-h.stopped:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkTcp connects to the address, with a TLS handshake if configured, and optionally sends a payload and waits for the expected response
+func (h *HealthChecker) checkTcp(address string) error {
+	result := make(chan error, 1)
+	report := func(err error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	var response []byte
+
+	client := NewTcpClient(address)
+	client.Name = h.Name + "_" + address
+	client.DialTimeout = h.Timeout
+	client.ProxyProtocol = h.ProxyProtocol
+	client.TlsConfig = h.TlsConfig
+	client.CbConnectFailed = report
+	client.CbConnected = func() {
+		if len(h.Expect) == 0 {
+			report(nil)
+		}
+	}
+	client.CbData = func(data []byte) {
+		response = append(response, data...)
+		if len(response) >= len(h.Expect) {
+			if bytes.HasPrefix(response, h.Expect) {
+				report(nil)
+			} else {
+				report(errors.New("unexpected response"))
+			}
+		}
+	}
+	client.Start()
+	defer client.Stop()
+	if len(h.Send) > 0 {
+		client.Send(h.Send)
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(h.Timeout):
+		return errors.New("timed out")
+	}
+}
+
+// udpHealthCheck keeps a UdpClient open to check a UDP target
+type udpHealthCheck struct {
+	client    *UdpClient
+	responses chan []byte
+}
+
+func newUdpHealthCheck(name, address string) *udpHealthCheck {
+	c := &udpHealthCheck{responses: make(chan []byte, 1)}
+	c.client = NewUdpClient(address)
+	c.client.Name = name + "_" + address
+	c.client.Consumer = func(data []byte) {
+		select {
+		case c.responses <- append([]byte{}, data...):
+		default:
+		}
+	}
+	c.client.Start()
+	return c
+}
+
+func (c *udpHealthCheck) check(send, expect []byte, timeout time.Duration) error {
+	// discard responses of previous checks
+	select {
+	case <-c.responses:
+	default:
+	}
+
+	c.client.Send(send)
+	deadline := time.After(timeout)
+	for {
+		select {
+		case response := <-c.responses:
+			if bytes.HasPrefix(response, expect) {
+				return nil
+			}
+		case <-deadline:
+			return errors.New("timed out")
+		}
+	}
+}
+
+func (c *udpHealthCheck) stop() {
+	c.client.Stop()
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpRoute sends requests for a host and path prefix to the targets of a balancer
+type httpRoute struct {
+	host       string
+	pathPrefix string
+	balancer   *Balancer
+}
+
+// matches checks the host, which may be empty for all hosts or a wildcard like *.example.com, and the path prefix
+func (r *httpRoute) matches(host, path string) bool {
+	if r.host != "" && r.host != host {
+		if wildcard, ok := wildcardName(host); !ok || r.host != wildcard {
+			return false
+		}
+	}
+	return hasPathPrefix(path, r.pathPrefix)
+}
+
+// hasPathPrefix checks if the path starts with the prefix at a segment boundary,
+// so that /api matches /api and /api/users, but not /apiv2
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// HttpProxy is a reverse proxy for HTTP/1.1, which routes requests by their Host header and path.
+// Keep-alive connections, chunked bodies and protocol upgrades like websockets are supported.
+type HttpProxy struct {
+	// activeRequests is accessed atomically
+	activeRequests int32
+	name           string
+	sourceAddress  string
+	// Balancer chooses the target for requests without a matching route
+	Balancer *Balancer
+	// DialTimeout is the timeout for connecting to a target
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout is the maximum time to wait for the response headers of a target
+	ResponseHeaderTimeout time.Duration
+	// ReadHeaderTimeout is the maximum time for reading the request headers of a source,
+	// so that slow sources can not hold connections open
+	ReadHeaderTimeout time.Duration
+	// SourceSocketOptions tune the sockets of the sources, if set
+	SourceSocketOptions *SocketOptions
+	// TargetSocketOptions tune the sockets to the targets, if set
+	TargetSocketOptions *SocketOptions
+	routes              []*httpRoute
+	server              *http.Server
+	transport           *http.Transport
+	// cancel aborts all requests, including upgraded connections, which the server does not track
+	cancel       context.CancelFunc
+	verbose      bool
+	statsPrinter *StatsPrinter
+	mutex        sync.Mutex
+	Proxy
+}
+
+// NewHttpProxy creates a new HTTP proxy with:
+// sourceAddress: The address to listen on
+// targets: The default targets for requests without a matching route
+func NewHttpProxy(sourceAddress string, targets []*Target) (p *HttpProxy) {
+	p = new(HttpProxy)
+	p.sourceAddress = sourceAddress
+	p.Balancer = NewBalancer(targets)
+	p.DialTimeout = 10 * time.Second
+	p.ResponseHeaderTimeout = time.Minute
+	p.ReadHeaderTimeout = 10 * time.Second
+	p.statsPrinter = NewStatsPrinter()
+	p.SetName("HttpProxy")
+	return
+}
+
+// SetName sets the name of the proxy for identification in logs
+func (p *HttpProxy) SetName(name string) {
+	p.name = name
+}
+
+// SetVerbose enables logging of every request
+func (p *HttpProxy) SetVerbose(verbose bool) {
+	p.verbose = verbose
+}
+
+// AddRoute sends requests for the host and path prefix to the targets of the balancer.
+// An empty host matches all hosts and a host like *.example.com matches its direct subdomains, like a Router.
+// The path prefix matches at a segment boundary, so /api matches /api/users, but not /apiv2.
+// The route with the longest matching path prefix is used, routes with a host take precedence.
+func (p *HttpProxy) AddRoute(host, pathPrefix string, balancer *Balancer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if pathPrefix == "" {
+		pathPrefix = "/"
+	}
+	p.routes = append(p.routes, &httpRoute{host: strings.ToLower(host), pathPrefix: pathPrefix, balancer: balancer})
+	sort.SliceStable(p.routes, func(i, j int) bool {
+		a, b := p.routes[i], p.routes[j]
+		if (a.host == "") != (b.host == "") {
+			return a.host != ""
+		}
+		return len(a.pathPrefix) > len(b.pathPrefix)
+	})
+}
+
+// Start listening for requests
+func (p *HttpProxy) Start() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.server != nil {
+		return
+	}
+
+	listener, err := p.SourceSocketOptions.listen("tcp", p.sourceAddress)
+	if err != nil {
+		log.Printf("%v - Could not listen at %v: %v", p.name, p.sourceAddress, err)
+		return
+	}
+	dialer := p.TargetSocketOptions.dialer(p.DialTimeout)
+	p.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err == nil {
+				if err = p.TargetSocketOptions.configure(conn); err != nil {
+					_ = conn.Close()
+					return nil, err
+				}
+			}
+			return conn, err
+		},
+		ResponseHeaderTimeout: p.ResponseHeaderTimeout,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.server = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: p.ReadHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	log.Printf("%v - Listening on %v", p.name, listener.Addr())
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("%v - Could not serve: %v", p.name, err)
+		}
+	}(p.server)
+}
+
+// Stop listening and close all connections
+func (p *HttpProxy) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.server == nil {
+		return
+	}
+	// the listener is already closed after a shutdown
+	if err := p.server.Close(); err != nil && !isClosedConnError(err) {
+		log.Printf("%v - Could not close server: %v", p.name, err)
+	}
+	p.cancel()
+	p.transport.CloseIdleConnections()
+	p.server = nil
+	log.Printf("%v - Stop listening on %v", p.name, p.sourceAddress)
+}
+
+// Shutdown stops accepting new connections and waits for the active requests, including upgraded connections,
+// to finish, until the context is done. The remaining ones are closed then.
+// It returns the number of finished and closed requests.
+func (p *HttpProxy) Shutdown(ctx context.Context) (drained, killed int) {
+	p.mutex.Lock()
+	server := p.server
+	p.mutex.Unlock()
+	if server == nil {
+		return 0, 0
+	}
+
+	active := int(atomic.LoadInt32(&p.activeRequests))
+	// the server closes idle connections and waits for active ones, but not for upgraded connections
+	if err := server.Shutdown(ctx); err == nil {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for atomic.LoadInt32(&p.activeRequests) > 0 && ctx.Err() == nil {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+		}
+	}
+	killed = int(atomic.LoadInt32(&p.activeRequests))
+	if drained = active - killed; drained < 0 {
+		// requests of keep-alive connections that started while shutting down
+		drained = 0
+	}
+	p.Stop()
+	log.Printf("%v - Shut down with %d drained and %d killed requests", p.name, drained, killed)
+	return
+}
+
+// ServeHTTP forwards a request to a target
+func (p *HttpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&p.activeRequests, 1)
+	defer atomic.AddInt32(&p.activeRequests, -1)
+
+	balancer := p.route(r)
+	if balancer == nil {
+		p.statsPrinter.NewMessage(p.name + ":no_route")
+		http.Error(w, "No route", http.StatusNotFound)
+		return
+	}
+	target, trial, ok := balancer.Acquire(remoteAddr(r))
+	if !ok {
+		log.Printf("%v - No target available for %v %v%v", p.name, r.RemoteAddr, r.Host, r.URL.Path)
+		p.statsPrinter.NewMessage(p.name + ":rejected")
+		http.Error(w, "No target available", http.StatusServiceUnavailable)
+		return
+	}
+	defer balancer.Release(target, trial)
+
+	if p.verbose {
+		log.Printf("%v - %v %v %v%v -> %v", p.name, r.RemoteAddr, r.Method, r.Host, r.URL.Path, target.Address)
+	}
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = target.Address
+			// X-Forwarded-For is added by the reverse proxy
+			proto := "http"
+			if req.TLS != nil {
+				proto = "https"
+			}
+			req.Header.Set("X-Forwarded-Proto", proto)
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		},
+		Transport: p.transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if req.Context().Err() == context.Canceled {
+				return
+			}
+			log.Printf("%v - Could not forward %v %v%v to %v: %v", p.name, req.Method, req.Host, req.URL.Path, target.Address, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	reverseProxy.ServeHTTP(w, r)
+}
+
+// route returns the balancer of the best matching route or the default balancer
+func (p *HttpProxy) route(r *http.Request) *Balancer {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, route := range p.routes {
+		if route.matches(host, r.URL.Path) {
+			return route.balancer
+		}
+	}
+	return p.Balancer
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHttpTestBackend responds with its name, the request path and the forwarding headers
+func newHttpTestBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%v %v for=%v proto=%v body=%s",
+			name, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"), body)
+	}))
+}
+
+func httpTestTarget(server *httptest.Server) []*Target {
+	return []*Target{{Address: server.Listener.Addr().String()}}
+}
+
+func httpGet(t *testing.T, client *http.Client, url, host string) string {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%v %s", res.StatusCode, body)
+}
+
+func TestHttpProxy_routing(t *testing.T) {
+	defaultBackend := newHttpTestBackend("default")
+	defer defaultBackend.Close()
+	apiBackend := newHttpTestBackend("api")
+	defer apiBackend.Close()
+	wildcardBackend := newHttpTestBackend("wildcard")
+	defer wildcardBackend.Close()
+	staticBackend := newHttpTestBackend("static")
+	defer staticBackend.Close()
+
+	proxy := NewHttpProxy("localhost:18200", httpTestTarget(defaultBackend))
+	proxy.SetName("HttpTestProxy")
+	proxy.AddRoute("example.com", "/api", NewBalancer(httpTestTarget(apiBackend)))
+	proxy.AddRoute("*.example.com", "/", NewBalancer(httpTestTarget(wildcardBackend)))
+	proxy.AddRoute("", "/static", NewBalancer(httpTestTarget(staticBackend)))
+	proxy.Start()
+	defer proxy.Stop()
+
+	client := &http.Client{Timeout: time.Second}
+	tests := []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{"example.com", "/api/users", "200 api /api/users"},
+		{"EXAMPLE.com:18200", "/api", "200 api /api"},
+		{"example.com", "/other", "200 default /other"},
+		{"www.example.com", "/api", "200 wildcard /api"},
+		// wildcards only match direct subdomains
+		{"a.www.example.com", "/api", "200 default /api"},
+		// prefixes only match at a segment boundary
+		{"example.com", "/apiv2", "200 default /apiv2"},
+		{"example.com", "/staticfiles", "200 default /staticfiles"},
+		{"example.com", "/static/app.js", "200 static /static/app.js"},
+		{"other.org", "/", "200 default /"},
+	}
+	for _, test := range tests {
+		actual := httpGet(t, client, "http://localhost:18200"+test.path, test.host)
+		if !strings.HasPrefix(actual, test.expected+" ") {
+			t.Errorf("Expected %v%v to be routed to '%v', but got '%v'", test.host, test.path, test.expected, actual)
+		}
+	}
+
+	proxy.Balancer = nil
+	if actual := httpGet(t, client, "http://localhost:18200/other", "other.org"); !strings.HasPrefix(actual, "404 ") {
+		t.Errorf("Expected 404 without a route, but got '%v'", actual)
+	}
+}
+
+func TestHttpProxy_forwarding(t *testing.T) {
+	backend := newHttpTestBackend("backend")
+	defer backend.Close()
+
+	proxy := NewHttpProxy("localhost:18300", httpTestTarget(backend))
+	proxy.SetName("HttpTestProxy")
+	proxy.Start()
+	defer proxy.Stop()
+
+	t.Run("Headers", func(t *testing.T) {
+		actual := httpGet(t, &http.Client{Timeout: time.Second}, "http://localhost:18300/", "example.com")
+		expected := "200 backend / for=127.0.0.1 proto=http body="
+		if actual != expected {
+			t.Errorf("Expected '%v', but got '%v'", expected, actual)
+		}
+	})
+
+	t.Run("Keep-alive and chunked body", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost:18300")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		reader := bufio.NewReader(conn)
+
+		for i := 0; i < 2; i++ {
+			_, err = io.WriteString(conn, "POST /echo HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n"+
+				"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("Could not read response %v: %v", i, err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+			if !strings.HasSuffix(string(body), "body=hello world") {
+				t.Errorf("Expected the chunked body to be forwarded, but got '%s'", body)
+			}
+		}
+	})
+
+	t.Run("No target", func(t *testing.T) {
+		backend.Close()
+		actual := httpGet(t, &http.Client{Timeout: time.Second}, "http://localhost:18300/", "example.com")
+		if !strings.HasPrefix(actual, "502 ") {
+			t.Errorf("Expected 502 for an unreachable target, but got '%v'", actual)
+		}
+	})
+}
+
+func TestHttpProxy_upgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = buf.Flush()
+		// echo everything in upper case
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte(strings.ToUpper(line)))
+	}))
+	defer backend.Close()
+
+	proxy := NewHttpProxy("localhost:18400", httpTestTarget(backend))
+	proxy.SetName("HttpTestProxy")
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn, err := net.Dial("tcp", "localhost:18400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, but got %v", res.StatusCode)
+	}
+
+	if _, err := io.WriteString(conn, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "HELLO\n" {
+		t.Errorf("Expected HELLO over the upgraded connection, but got '%v'", line)
+	}
+}
+
+func TestHttpProxy_shutdown(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		} else {
+			<-release
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+	// the hanging request has to be released before the backend can be closed
+	defer close(release)
+
+	proxy := NewHttpProxy("localhost:19700", httpTestTarget(backend))
+	proxy.SetName("HttpTestProxy")
+	proxy.Start()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	results := make(chan string, 2)
+	for _, path := range []string{"/slow", "/hanging"} {
+		go func(path string) {
+			res, err := client.Get("http://localhost:19700" + path)
+			if err != nil {
+				results <- path + " failed"
+				return
+			}
+			_ = res.Body.Close()
+			results <- fmt.Sprintf("%v %v", path, res.StatusCode)
+		}(path)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	drained, killed := proxy.Shutdown(ctx)
+	if drained != 1 || killed != 1 {
+		t.Errorf("Expected 1 drained and 1 killed request, but got %d and %d", drained, killed)
+	}
+	for _, expected := range []string{"/slow 200", "/hanging failed"} {
+		select {
+		case res := <-results:
+			if res != expected {
+				t.Errorf("Expected %v, but got %v", expected, res)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+}
+
+func TestHttpProxy_read_header_timeout(t *testing.T) {
+	backend := newHttpTestBackend("default")
+	defer backend.Close()
+
+	proxy := NewHttpProxy("localhost:18250", httpTestTarget(backend))
+	proxy.SetName("HttpTestProxy")
+	proxy.ReadHeaderTimeout = 200 * time.Millisecond
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn, err := net.Dial("tcp", "localhost:18250")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	// a slow source never finishes its headers
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Errorf("Expected the connection to be closed after the header timeout, but got %v", err)
+	}
+}
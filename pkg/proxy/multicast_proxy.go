@@ -1,6 +1,9 @@
 package proxy
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 type MulticastProxy struct {
 	name          string
@@ -8,7 +11,11 @@ type MulticastProxy struct {
 	targetAddress string
 	source        *MulticastServer
 	target        *UdpClient
-	statsPrinter  *StatsPrinter
+	// SourceSocketOptions tune the sockets of the sources, if set
+	SourceSocketOptions *SocketOptions
+	// TargetSocketOptions tune the sockets to the targets, if set
+	TargetSocketOptions *SocketOptions
+	statsPrinter        *StatsPrinter
 	Proxy
 }
 
@@ -43,6 +50,8 @@ func (p *MulticastProxy) newDataFromTarget(_ []byte) {
 }
 
 func (p *MulticastProxy) Start() {
+	p.source.SocketOptions = p.SourceSocketOptions
+	p.target.SocketOptions = p.TargetSocketOptions
 	p.target.Start()
 	p.source.Start()
 }
@@ -52,6 +61,12 @@ func (p *MulticastProxy) Stop() {
 	p.target.Stop()
 }
 
+// Shutdown stops the proxy right away, because multicast has no sessions to wait for
+func (p *MulticastProxy) Shutdown(context.Context) (drained, killed int) {
+	p.Stop()
+	return 0, 0
+}
+
 func (p *MulticastProxy) SkipInterfaces(ifis []string) {
 	p.source.SkipInterfaces = ifis
 }
@@ -65,3 +65,74 @@ func TestMulticastProxy_roundtrip(t *testing.T) {
 		}
 	})
 }
+
+// ipv6MulticastInterface returns an interface, which can send IPv6 multicast from a link-local address
+func ipv6MulticastInterface() (string, bool) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return "", false
+	}
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return ifi.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func TestMulticastProxy_ipv6(t *testing.T) {
+	ifi, ok := ipv6MulticastInterface()
+	if !ok {
+		t.Skip("No interface with IPv6 multicast support")
+	}
+	req := "Request"
+	sourceAddress := "[ff02::114%" + ifi + "]:15010"
+	targetAddress := "[ff05::114%" + ifi + "]:15011"
+
+	cRecv := make(chan net.Interface, 1)
+	server := NewMulticastServer(targetAddress)
+	server.Consumer = func(data []byte, ifi net.Interface) {
+		if string(data) != req {
+			t.Errorf("Expected to receive %s, but got %s", req, data)
+		}
+		select {
+		case cRecv <- ifi:
+		default:
+		}
+	}
+	server.name = "McTestServer"
+	server.Start()
+	defer server.Stop()
+
+	proxy := NewMulticastProxy(sourceAddress, targetAddress)
+	proxy.SetName("McTestProxy")
+	proxy.Start()
+	defer proxy.Stop()
+
+	client := NewUdpClient(sourceAddress)
+	client.Name = "McTestClient"
+	client.Start()
+	defer client.Stop()
+
+	for i := 0; i < 50; i++ {
+		client.Send([]byte(req))
+		select {
+		case received := <-cRecv:
+			if received.Name != ifi {
+				t.Errorf("Expected to receive on %v, but got %v", ifi, received.Name)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Error("Timed out")
+}
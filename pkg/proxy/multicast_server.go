@@ -16,10 +16,14 @@ type MulticastServer struct {
 	Consumer         func([]byte, net.Interface)
 	mutex            sync.Mutex
 	SkipInterfaces   []string
-	receivers        sync.WaitGroup
-	statsPrinter     *StatsPrinter
+	// SocketOptions tune the socket, if set
+	SocketOptions *SocketOptions
+	receivers     sync.WaitGroup
+	statsPrinter  *StatsPrinter
 }
 
+// NewMulticastServer creates a new multicast server for an IPv4 or IPv6 group, like 224.0.0.1:10000 or [ff02::1]:10000.
+// A zone restricts an IPv6 group to a single interface, like [ff02::1%eth0]:10000.
 func NewMulticastServer(multicastAddress string) (r *MulticastServer) {
 	r = new(MulticastServer)
 	r.name = "MulticastServer"
@@ -86,9 +90,14 @@ func (r *MulticastServer) interfaces() (interfaces []net.Interface) {
 		log.Printf("%v - Could not get available interfaces: %v", r.name, err)
 		return
 	}
+	zone := ""
+	if addr, err := net.ResolveUDPAddr("udp", r.multicastAddress); err == nil {
+		zone = addr.Zone
+	}
 	for _, ifi := range ifis {
 		if ifi.Flags&net.FlagMulticast == 0 || // No multicast support
-			r.skipInterface(ifi.Name) {
+			r.skipInterface(ifi.Name) ||
+			(zone != "" && zone != ifi.Name) {
 			continue
 		}
 		interfaces = append(interfaces, ifi)
@@ -121,8 +130,8 @@ func (r *MulticastServer) receiveOnInterface(ifi net.Interface) {
 	r.receivers.Add(1)
 	defer r.receivers.Done()
 
-	if err := conn.SetReadBuffer(maxDatagramSize); err != nil {
-		log.Printf("%v - Could not set read buffer: %v", r.name, err)
+	if err := r.SocketOptions.applyUdp(conn); err != nil {
+		log.Printf("%v - Could not set socket options: %v", r.name, err)
 	}
 
 	if r.Verbose {
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolVersion selects the version of the HAProxy PROXY protocol header
+type ProxyProtocolVersion int
+
+const (
+	// ProxyProtocolNone does not send a header
+	ProxyProtocolNone ProxyProtocolVersion = iota
+	// ProxyProtocolV1 sends a human readable header
+	ProxyProtocolV1
+	// ProxyProtocolV2 sends a binary header
+	ProxyProtocolV2
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader creates a PROXY protocol header for a connection from source to destination.
+// If the addresses are not TCP addresses of the same family, the header does not contain any addresses.
+// Without a source, the connection is not proxied, like a health check, and v2 uses the LOCAL command.
+func proxyHeader(version ProxyProtocolVersion, source, destination net.Addr) ([]byte, error) {
+	srcIP, srcPort, dstIP, dstPort, ok := proxyAddresses(source, destination)
+	switch version {
+	case ProxyProtocolV1:
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP4"
+		if srcIP.To4() == nil {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort)), nil
+	case ProxyProtocolV2:
+		header := append([]byte{}, proxyProtocolV2Signature...)
+		if source == nil {
+			// LOCAL command without addresses
+			return append(header, 0x20, 0x00, 0x00, 0x00), nil
+		}
+		if !ok {
+			// PROXY command with an unknown (UNSPEC) family and without addresses
+			return append(header, 0x21, 0x00, 0x00, 0x00), nil
+		}
+		var addresses []byte
+		if ip4 := srcIP.To4(); ip4 != nil {
+			// PROXY command, TCP over IPv4
+			header = append(header, 0x21, 0x11)
+			addresses = append(append(addresses, ip4...), dstIP.To4()...)
+		} else {
+			// PROXY command, TCP over IPv6
+			header = append(header, 0x21, 0x21)
+			addresses = append(append(addresses, srcIP.To16()...), dstIP.To16()...)
+		}
+		addresses = appendUint16(addresses, srcPort)
+		addresses = appendUint16(addresses, dstPort)
+		header = appendUint16(header, len(addresses))
+		return append(header, addresses...), nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version: %d", version)
+}
+
+func appendUint16(data []byte, value int) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(value))
+	return append(data, buf[:]...)
+}
+
+// proxyAddresses returns the IPs and ports of both addresses, if they are TCP addresses of the same family
+func proxyAddresses(source, destination net.Addr) (srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, ok bool) {
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		return
+	}
+	if (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		return
+	}
+	return src.IP, src.Port, dst.IP, dst.Port, true
+}
+
+// errNoProxyHeader is returned by readProxyHeader, if the data does not start with a PROXY protocol header
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+// proxyProtocolV1Signature starts every PROXY protocol v1 header
+var proxyProtocolV1Signature = []byte("PROXY ")
+
+// maxProxyHeaderV1Length is the maximum length of a v1 header, including the CRLF
+const maxProxyHeaderV1Length = 107
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, without reading beyond its end.
+// The returned addresses are nil, if the header does not contain TCP addresses (LOCAL or UNKNOWN).
+// If the data does not start with a header, errNoProxyHeader and the already read bytes are returned.
+// This includes sources that close the connection or wait for the server to speak first, which ends
+// with EOF or a timeout before a complete signature was read.
+func readProxyHeader(r io.Reader) (source, destination net.Addr, prefix []byte, err error) {
+	var b [1]byte
+	for {
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			var netErr net.Error
+			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				err = fmt.Errorf("%w: %v", errNoProxyHeader, err)
+			}
+			return nil, nil, prefix, err
+		}
+		prefix = append(prefix, b[0])
+		isV1 := bytes.HasPrefix(proxyProtocolV1Signature, prefix)
+		isV2 := bytes.HasPrefix(proxyProtocolV2Signature, prefix)
+		switch {
+		case isV1 && len(prefix) == len(proxyProtocolV1Signature):
+			source, destination, err = readProxyHeaderV1(r)
+			return source, destination, nil, err
+		case isV2 && len(prefix) == len(proxyProtocolV2Signature):
+			source, destination, err = readProxyHeaderV2(r)
+			return source, destination, nil, err
+		case !isV1 && !isV2:
+			return nil, nil, prefix, errNoProxyHeader
+		}
+	}
+}
+
+// readProxyHeaderV1 reads the remaining v1 header after the signature
+func readProxyHeaderV1(r io.Reader) (source, destination net.Addr, err error) {
+	line := make([]byte, 0, maxProxyHeaderV1Length)
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line)+len(proxyProtocolV1Signature) >= maxProxyHeaderV1Length {
+			return nil, nil, errors.New("PROXY protocol v1 header too long")
+		}
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v1 header: %q", line)
+	}
+	src, err := parseProxyAddrV1(fields[0], fields[1], fields[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddrV1(fields[0], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddrV1(family, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	isIPv4 := ip != nil && !strings.Contains(host, ":")
+	if ip == nil || isIPv4 != (family == "TCP4") {
+		return nil, fmt.Errorf("invalid %v address in PROXY protocol v1 header: %v", family, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in PROXY protocol v1 header: %v", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyHeaderV2 reads the remaining v2 header after the signature
+func readProxyHeaderV2(r io.Reader) (source, destination net.Addr, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+	if header[0]>>4 != 2 {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v2 version: %d", header[0]>>4)
+	}
+	command := header[0] & 0x0f
+	if command > 1 {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v2 command: %d", command)
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err = io.ReadFull(r, addresses); err != nil {
+		return nil, nil, err
+	}
+	if command == 0 {
+		// LOCAL, for example health checks of the load balancer
+		return nil, nil, nil
+	}
+
+	var ipLen int
+	switch header[1] {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		// no TCP addresses
+		return nil, nil, nil
+	}
+	if len(addresses) < 2*ipLen+4 {
+		return nil, nil, errors.New("PROXY protocol v2 addresses too short")
+	}
+	ports := addresses[2*ipLen:]
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, addresses[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(ports)),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, addresses[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(ports[2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func parseProxyHeaderV1(data []byte) (src, dst *net.TCPAddr, payload []byte, err error) {
+	end := strings.Index(string(data), "\r\n")
+	if end < 0 {
+		return nil, nil, nil, errors.New("missing end of header")
+	}
+	fields := strings.Fields(string(data[:end]))
+	if len(fields) != 6 || fields[0] != "PROXY" || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, nil, errors.New("invalid header: " + string(data[:end]))
+	}
+	srcPort, _ := strconv.Atoi(fields[4])
+	dstPort, _ := strconv.Atoi(fields[5])
+	src = &net.TCPAddr{IP: net.ParseIP(fields[2]), Port: srcPort}
+	dst = &net.TCPAddr{IP: net.ParseIP(fields[3]), Port: dstPort}
+	return src, dst, data[end+2:], nil
+}
+
+func parseProxyHeaderV2(data []byte) (src, dst *net.TCPAddr, payload []byte, err error) {
+	if len(data) < 16 || string(data[:12]) != "\r\n\r\n\x00\r\nQUIT\n" {
+		return nil, nil, nil, errors.New("missing signature")
+	}
+	if data[12] != 0x21 {
+		return nil, nil, nil, errors.New("unexpected version and command")
+	}
+	length := int(data[14])<<8 | int(data[15])
+	addresses := data[16:]
+	if len(addresses) < length {
+		return nil, nil, nil, errors.New("truncated header")
+	}
+	ipLen := 4
+	if data[13] == 0x21 {
+		ipLen = 16
+	} else if data[13] != 0x11 {
+		return nil, nil, nil, errors.New("unexpected address family")
+	}
+	if length != 2*ipLen+4 {
+		return nil, nil, nil, errors.New("unexpected address length")
+	}
+	port := func(b []byte) int { return int(b[0])<<8 | int(b[1]) }
+	src = &net.TCPAddr{IP: net.IP(addresses[:ipLen]), Port: port(addresses[2*ipLen:])}
+	dst = &net.TCPAddr{IP: net.IP(addresses[ipLen : 2*ipLen]), Port: port(addresses[2*ipLen+2:])}
+	return src, dst, addresses[length:], nil
+}
+
+func TestProxyHeader_without_addresses(t *testing.T) {
+	signature := "\r\n\r\n\x00\r\nQUIT\n"
+	unix := &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}
+	tests := []struct {
+		name                string
+		source, destination net.Addr
+		expected            string
+	}{
+		// a proxied connection with unknown addresses uses the PROXY command with the UNSPEC family
+		{"Unknown", unix, unix, signature + "\x21\x00\x00\x00"},
+		{"MixedFamilies", &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, &net.TCPAddr{IP: net.ParseIP("::1")}, signature + "\x21\x00\x00\x00"},
+		// a connection of the proxy itself, like a health check, uses the LOCAL command
+		{"Local", nil, nil, signature + "\x20\x00\x00\x00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, err := proxyHeader(ProxyProtocolV2, test.source, test.destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(header) != test.expected {
+				t.Errorf("Expected header %q, but got %q", test.expected, header)
+			}
+			source, destination, _, err := readProxyHeader(bytes.NewReader(header))
+			if err != nil || source != nil || destination != nil {
+				t.Errorf("Expected a valid header without addresses, but got %v, %v and %v", source, destination, err)
+			}
+		})
+	}
+}
+
+func TestProxyHeader_roundtrip(t *testing.T) {
+	ipv4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	ipv4Destination := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443}
+	ipv6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	ipv6Destination := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	tests := []struct {
+		name                string
+		version             ProxyProtocolVersion
+		source, destination *net.TCPAddr
+	}{
+		{"V1 IPv4", ProxyProtocolV1, ipv4, ipv4Destination},
+		{"V1 IPv6", ProxyProtocolV1, ipv6, ipv6Destination},
+		{"V2 IPv4", ProxyProtocolV2, ipv4, ipv4Destination},
+		{"V2 IPv6", ProxyProtocolV2, ipv6, ipv6Destination},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, err := proxyHeader(test.version, test.source, test.destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := bytes.NewReader(append(header, "payload"...))
+			source, destination, prefix, err := readProxyHeader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source.String() != test.source.String() || destination.String() != test.destination.String() || len(prefix) != 0 {
+				t.Errorf("Expected %v -> %v, but got %v -> %v and prefix %q", test.source, test.destination, source, destination, prefix)
+			}
+			// the header is not read beyond its end
+			if payload, _ := ioutil.ReadAll(reader); string(payload) != "payload" {
+				t.Errorf("Expected the payload after the header, but got %q", payload)
+			}
+		})
+	}
+
+	header, err := proxyHeader(ProxyProtocolV1, &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, ipv4Destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source, destination, _, err := readProxyHeader(bytes.NewReader(header)); err != nil || source != nil || destination != nil {
+		t.Errorf("Expected a valid v1 header without addresses, but got %v, %v and %v", source, destination, err)
+	}
+}
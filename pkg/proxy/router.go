@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"strings"
+	"sync"
+)
+
+// Router chooses a balancer by name, for example by the identity of a client certificate.
+// Names are matched case-insensitively. A route for "*.example.com" matches all direct subdomains of example.com.
+type Router struct {
+	// Default is used, if no route matches. Without it, unmatched connections are rejected.
+	Default *Balancer
+	routes  map[string]*Balancer
+	mutex   sync.Mutex
+}
+
+// NewRouter creates a new router without any routes
+func NewRouter() *Router {
+	return &Router{routes: map[string]*Balancer{}}
+}
+
+// Add a route for the name, which may be a wildcard like *.example.com. The name "*" sets the default.
+func (r *Router) Add(name string, balancer *Balancer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if name == "*" {
+		r.Default = balancer
+		return
+	}
+	r.routes[strings.ToLower(name)] = balancer
+}
+
+// Balancers returns the balancers of all routes, including the default
+func (r *Router) Balancers() (balancers []*Balancer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, balancer := range r.routes {
+		balancers = append(balancers, balancer)
+	}
+	if r.Default != nil {
+		balancers = append(balancers, r.Default)
+	}
+	return
+}
+
+// Route returns the balancer for the first of the names with an exact route. If there is none,
+// the first wildcard route that matches one of the names is used, and then the default.
+func (r *Router) Route(names ...string) (*Balancer, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, name := range names {
+		if balancer, ok := r.routes[strings.ToLower(name)]; ok {
+			return balancer, true
+		}
+	}
+	for _, name := range names {
+		if wildcard, ok := wildcardName(strings.ToLower(name)); ok {
+			if balancer, ok := r.routes[wildcard]; ok {
+				return balancer, true
+			}
+		}
+	}
+	return r.Default, r.Default != nil
+}
+
+// wildcardName returns the wildcard that matches the name, like *.example.com for www.example.com.
+// Wildcards only match direct subdomains, so a.b.example.com is matched by *.b.example.com only.
+func wildcardName(name string) (string, bool) {
+	i := strings.Index(name, ".")
+	if i <= 0 {
+		return "", false
+	}
+	return "*" + name[i:], true
+}
+
+// certificateIdentities returns the common name and all subject alternative names of the certificate
+func certificateIdentities(cert *x509.Certificate) (names []string) {
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return
+}
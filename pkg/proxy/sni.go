@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	tlsRecordTypeHandshake  = 0x16
+	tlsHandshakeClientHello = 0x01
+	tlsExtensionServerName  = 0x0000
+	// maxClientHelloSize limits the bytes that are buffered while reading a ClientHello
+	maxClientHelloSize = 64 * 1024
+)
+
+var errInvalidClientHello = errors.New("invalid TLS ClientHello")
+
+// readClientHello reads the TLS records that contain the ClientHello and returns the requested server name (SNI).
+// All read bytes are returned as well, so that they can be replayed to the target.
+// The server name is empty, if the client did not send one.
+func readClientHello(r io.Reader) (serverName string, hello []byte, err error) {
+	var buf bytes.Buffer
+	r = io.TeeReader(r, &buf)
+
+	// the ClientHello may be fragmented into multiple records
+	var message []byte
+	for len(message) < 4 || len(message) < 4+int(uint24(message[1:])) {
+		var header [5]byte
+		if _, err = io.ReadFull(r, header[:]); err != nil {
+			return "", buf.Bytes(), err
+		}
+		if header[0] != tlsRecordTypeHandshake {
+			return "", buf.Bytes(), errInvalidClientHello
+		}
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if buf.Len()+length > maxClientHelloSize {
+			return "", buf.Bytes(), errors.New("TLS ClientHello too large")
+		}
+		fragment := make([]byte, length)
+		if _, err = io.ReadFull(r, fragment); err != nil {
+			return "", buf.Bytes(), err
+		}
+		message = append(message, fragment...)
+	}
+	if message[0] != tlsHandshakeClientHello {
+		return "", buf.Bytes(), errInvalidClientHello
+	}
+
+	serverName, err = parseServerName(message[4 : 4+uint24(message[1:])])
+	return serverName, buf.Bytes(), err
+}
+
+// parseServerName extracts the host name from the server name extension of a ClientHello message body
+func parseServerName(body []byte) (string, error) {
+	p := clientHelloParser{data: body}
+	p.skip(2 + 32)          // version and random
+	p.skip(int(p.uint8()))  // session id
+	p.skip(int(p.uint16())) // cipher suites
+	p.skip(int(p.uint8()))  // compression methods
+	if p.err == nil && len(p.data) == 0 {
+		// no extensions
+		return "", nil
+	}
+	extensions := clientHelloParser{data: p.bytes(int(p.uint16()))}
+	for p.err == nil && extensions.err == nil && len(extensions.data) > 0 {
+		extType := extensions.uint16()
+		extData := extensions.bytes(int(extensions.uint16()))
+		if extType != tlsExtensionServerName {
+			continue
+		}
+		names := clientHelloParser{data: extData}
+		names = clientHelloParser{data: names.bytes(int(names.uint16()))}
+		for names.err == nil && len(names.data) > 0 {
+			nameType := names.uint8()
+			name := names.bytes(int(names.uint16()))
+			if names.err == nil && nameType == 0 {
+				return string(name), nil
+			}
+		}
+		if names.err != nil {
+			return "", names.err
+		}
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+	return "", extensions.err
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// clientHelloParser reads big endian values and remembers the first error
+type clientHelloParser struct {
+	data []byte
+	err  error
+}
+
+func (p *clientHelloParser) bytes(n int) []byte {
+	if p.err != nil || len(p.data) < n {
+		p.err = errInvalidClientHello
+		return nil
+	}
+	b := p.data[:n]
+	p.data = p.data[n:]
+	return b
+}
+
+func (p *clientHelloParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *clientHelloParser) uint8() uint8 {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *clientHelloParser) uint16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"time"
+)
+
+// Names of the protocols that are detected by default
+const (
+	ProtocolTls   = "tls"
+	ProtocolHttp  = "http"
+	ProtocolHttp2 = "http2"
+	ProtocolSsh   = "ssh"
+)
+
+// sniffResult is the state of a protocol detection rule for the data read so far
+type sniffResult int
+
+const (
+	sniffNeedMore sniffResult = iota
+	sniffMatch
+	sniffNoMatch
+)
+
+type sniffRule struct {
+	protocol string
+	match    func(data []byte, final bool) sniffResult
+}
+
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// Sniffer classifies connections by their first bytes
+type Sniffer struct {
+	// Timeout for receiving enough data to classify a connection
+	Timeout time.Duration
+	// MaxBytes is the maximum number of bytes that are read for the classification
+	MaxBytes int
+	rules    []sniffRule
+}
+
+// NewSniffer creates a sniffer that detects TLS, HTTP/2, HTTP/1.x and SSH
+func NewSniffer() (s *Sniffer) {
+	s = new(Sniffer)
+	s.Timeout = 1 * time.Second
+	s.MaxBytes = 256
+	s.AddPrefix(ProtocolTls, []byte{tlsRecordTypeHandshake, 0x03})
+	// the HTTP/2 preface would also look like an HTTP/1.x request
+	s.AddPrefix(ProtocolHttp2, http2Preface)
+	s.rules = append(s.rules, sniffRule{protocol: ProtocolHttp, match: matchHttp})
+	s.AddPrefix(ProtocolSsh, []byte("SSH-"))
+	return
+}
+
+// AddPrefix detects the protocol by a fixed byte prefix. Rules are checked in the order they were added.
+func (s *Sniffer) AddPrefix(protocol string, prefix []byte) {
+	s.rules = append(s.rules, sniffRule{protocol: protocol, match: func(data []byte, final bool) sniffResult {
+		return matchPrefix(data, prefix, final)
+	}})
+}
+
+// AddRegexp detects the protocol by a regular expression that matches the first bytes.
+// Use ^ to anchor the expression at the start of the connection.
+func (s *Sniffer) AddRegexp(protocol string, re *regexp.Regexp) {
+	s.rules = append(s.rules, sniffRule{protocol: protocol, match: func(data []byte, final bool) sniffResult {
+		if re.Match(data) {
+			return sniffMatch
+		}
+		if final {
+			return sniffNoMatch
+		}
+		return sniffNeedMore
+	}})
+}
+
+// Sniff reads from the connection until the protocol is detected, MaxBytes were read or the Timeout expired.
+// The read bytes are returned and the protocol is empty, if no rule matched.
+func (s *Sniffer) Sniff(conn net.Conn) (protocol string, data []byte, err error) {
+	if s.Timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.Timeout)); err != nil {
+			return "", nil, err
+		}
+	}
+	buf := make([]byte, s.MaxBytes)
+	for {
+		// errors are detected again by the next read of the connection
+		n, readErr := conn.Read(buf[len(data):])
+		data = buf[:len(data)+n]
+		final := readErr != nil || len(data) == len(buf)
+		if protocol, decided := s.classify(data, final); decided {
+			return protocol, data, conn.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+// classify returns the protocol of the first matching rule, as soon as all previous rules did not match
+func (s *Sniffer) classify(data []byte, final bool) (protocol string, decided bool) {
+	for _, rule := range s.rules {
+		switch rule.match(data, final) {
+		case sniffMatch:
+			return rule.protocol, true
+		case sniffNeedMore:
+			return "", false
+		}
+	}
+	return "", true
+}
+
+func matchPrefix(data, prefix []byte, final bool) sniffResult {
+	if len(data) >= len(prefix) {
+		if bytes.HasPrefix(data, prefix) {
+			return sniffMatch
+		}
+		return sniffNoMatch
+	}
+	if !bytes.HasPrefix(prefix, data) || final {
+		return sniffNoMatch
+	}
+	return sniffNeedMore
+}
+
+// matchHttp detects an HTTP/1.x request line by its method
+func matchHttp(data []byte, final bool) sniffResult {
+	result := sniffNoMatch
+	for _, method := range httpMethods {
+		switch matchPrefix(data, []byte(method+" "), final) {
+		case sniffMatch:
+			return sniffMatch
+		case sniffNeedMore:
+			result = sniffNeedMore
+		}
+	}
+	return result
+}
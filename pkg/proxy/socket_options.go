@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SocketOptions tune the sockets of one side of a proxy. Zero values keep the defaults of the operating system.
+// Accepted connections inherit the options of the listening socket.
+type SocketOptions struct {
+	// KeepAlive is the idle time before TCP keepalive probes are sent and the interval between them.
+	// Zero uses the default of 15s, a negative value disables keepalives.
+	KeepAlive time.Duration
+	// KeepAliveCount is the number of unanswered TCP keepalive probes before a connection is dropped (TCP_KEEPCNT).
+	// It is only supported on Linux.
+	KeepAliveCount int
+	// NoDelay sets TCP_NODELAY, if not nil. It is enabled by default, disabling it enables Nagle's algorithm.
+	NoDelay *bool
+	// ReceiveBuffer is the size of the kernel receive buffer in bytes (SO_RCVBUF)
+	ReceiveBuffer int
+	// SendBuffer is the size of the kernel send buffer in bytes (SO_SNDBUF)
+	SendBuffer int
+	// Dscp marks outgoing packets with a Differentiated Services Code Point from 1 to 63 (IP_TOS, IPV6_TCLASS)
+	Dscp int
+	// Ttl is the time to live of outgoing unicast packets (IP_TTL, IPV6_UNICAST_HOPS)
+	Ttl int
+	// Mark is the firewall mark of outgoing packets (SO_MARK). It requires CAP_NET_ADMIN and is only supported on Linux.
+	Mark int
+}
+
+// ParseSocketOptions parses comma separated options, like keepalive=30s,nodelay=false,rcvbuf=4194304,dscp=46.
+// The keys are keepalive, keepalive-count, nodelay, rcvbuf, sndbuf, dscp, ttl and mark.
+func ParseSocketOptions(spec string) (*SocketOptions, error) {
+	o := new(SocketOptions)
+	for _, option := range strings.Split(spec, ",") {
+		if option == "" {
+			continue
+		}
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected key=value: %v", option)
+		}
+		key, value := parts[0], parts[1]
+		var err error
+		switch key {
+		case "keepalive":
+			o.KeepAlive, err = time.ParseDuration(value)
+		case "keepalive-count":
+			o.KeepAliveCount, err = parseSocketOptionInt(value, 0, 127)
+		case "nodelay":
+			var noDelay bool
+			noDelay, err = strconv.ParseBool(value)
+			o.NoDelay = &noDelay
+		case "rcvbuf":
+			o.ReceiveBuffer, err = parseSocketOptionInt(value, 0, 1<<30)
+		case "sndbuf":
+			o.SendBuffer, err = parseSocketOptionInt(value, 0, 1<<30)
+		case "dscp":
+			o.Dscp, err = parseSocketOptionInt(value, 0, 63)
+		case "ttl":
+			o.Ttl, err = parseSocketOptionInt(value, 0, 255)
+		case "mark":
+			o.Mark, err = parseSocketOptionInt(value, 0, 1<<31-1)
+		default:
+			return nil, fmt.Errorf("unknown socket option: %v", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for socket option %v: %w", key, err)
+		}
+	}
+	return o, nil
+}
+
+func parseSocketOptionInt(value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d is not between %d and %d", n, min, max)
+	}
+	return n, nil
+}
+
+// listenConfig creates a ListenConfig, which applies the options to the listening socket
+func (o *SocketOptions) listenConfig() *net.ListenConfig {
+	if o == nil {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: o.control, KeepAlive: o.KeepAlive}
+}
+
+// dialer creates a Dialer, which applies the options before connecting
+func (o *SocketOptions) dialer(timeout time.Duration) *net.Dialer {
+	if o == nil {
+		return &net.Dialer{Timeout: timeout}
+	}
+	return &net.Dialer{Timeout: timeout, Control: o.control, KeepAlive: o.KeepAlive}
+}
+
+// control sets the options on a new socket. It is used as Control hook of a ListenConfig or Dialer.
+func (o *SocketOptions) control(network, _ string, c syscall.RawConn) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = o.setSocketOptions(network, fd)
+	}); controlErr != nil {
+		return controlErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not set socket options: %w", err)
+	}
+	return nil
+}
+
+// applyUdp sets the options on a UDP socket, which was not created with a control hook
+func (o *SocketOptions) applyUdp(conn *net.UDPConn) error {
+	if o == nil {
+		return nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	network := "udp4"
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	return o.control(network, "", raw)
+}
+
+// needsConfigure checks if there are options that have to be set on every connection
+func (o *SocketOptions) needsConfigure() bool {
+	return o != nil && (o.NoDelay != nil || o.KeepAliveCount > 0)
+}
+
+// configure sets the options that Go overrides after connecting, TCP_NODELAY and the keepalive settings
+func (o *SocketOptions) configure(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || !o.needsConfigure() {
+		return nil
+	}
+	if o.NoDelay != nil {
+		if err := tcpConn.SetNoDelay(*o.NoDelay); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveCount > 0 {
+		raw, err := tcpConn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if controlErr := raw.Control(func(fd uintptr) {
+			err = o.setKeepAliveCount(fd)
+		}); controlErr != nil {
+			return controlErr
+		}
+		if err != nil {
+			return fmt.Errorf("could not set socket options: %w", err)
+		}
+	}
+	return nil
+}
+
+// socketListener configures accepted connections. Connections that can not be configured are closed.
+type socketListener struct {
+	net.Listener
+	options *SocketOptions
+}
+
+func (l *socketListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := l.options.configure(conn); err != nil {
+			log.Printf("%v - Could not configure connection of %v: %v", l.Addr(), conn.RemoteAddr(), err)
+			_ = conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// listen listens on a stream socket with the options
+func (o *SocketOptions) listen(network, address string) (net.Listener, error) {
+	listener, err := o.listenConfig().Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if !o.needsConfigure() {
+		return listener, nil
+	}
+	return &socketListener{Listener: listener, options: o}, nil
+}
+
+// listenUdp listens on a UDP socket with the options
+func (o *SocketOptions) listenUdp(address string) (*net.UDPConn, error) {
+	conn, err := o.listenConfig().ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// dialUdp connects a UDP socket from laddr to addr with the options
+func (o *SocketOptions) dialUdp(laddr, addr *net.UDPAddr) (*net.UDPConn, error) {
+	dialer := o.dialer(0)
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	conn, err := dialer.Dial("udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// setSocketOptions sets the options with setsockopt on a socket of the given network, like tcp4 or udp6
+func (o *SocketOptions) setSocketOptions(network string, fd uintptr) error {
+	type option struct {
+		name                  string
+		level, optname, value int
+	}
+	var options []option
+	if o.ReceiveBuffer > 0 {
+		options = append(options, option{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.ReceiveBuffer})
+	}
+	if o.SendBuffer > 0 {
+		options = append(options, option{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer})
+	}
+	if o.Mark > 0 {
+		options = append(options, option{"SO_MARK", syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark})
+	}
+	if strings.HasPrefix(network, "tcp") || strings.HasPrefix(network, "udp") {
+		// IPv6 sockets also send IPv4 packets for IPv4-mapped addresses
+		ipv6 := strings.HasSuffix(network, "6")
+		if o.Dscp > 0 {
+			options = append(options, option{"IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS, o.Dscp << 2})
+			if ipv6 {
+				options = append(options, option{"IPV6_TCLASS", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, o.Dscp << 2})
+			}
+		}
+		if o.Ttl > 0 {
+			options = append(options, option{"IP_TTL", syscall.IPPROTO_IP, syscall.IP_TTL, o.Ttl})
+			if ipv6 {
+				options = append(options, option{"IPV6_UNICAST_HOPS", syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, o.Ttl})
+			}
+		}
+	}
+	for _, opt := range options {
+		if err := syscall.SetsockoptInt(int(fd), opt.level, opt.optname, opt.value); err != nil {
+			return fmt.Errorf("%v: %w", opt.name, err)
+		}
+	}
+	return nil
+}
+
+// setKeepAliveCount sets the keepalive count of a TCP connection
+func (o *SocketOptions) setKeepAliveCount(fd uintptr) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, o.KeepAliveCount); err != nil {
+		return fmt.Errorf("TCP_KEEPCNT: %w", err)
+	}
+	return nil
+}
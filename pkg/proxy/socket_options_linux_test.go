@@ -0,0 +1,152 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// getSocketOption reads an option of the socket of a connection with getsockopt
+func getSocketOption(t *testing.T, conn syscall.Conn, level, name int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	if err := raw.Control(func(fd uintptr) {
+		value, err = syscall.GetsockoptInt(int(fd), level, name)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+type expectedSocketOption struct {
+	name        string
+	level, opt  int
+	value       int
+	orMoreValue bool
+}
+
+func checkSocketOptions(t *testing.T, side string, conn syscall.Conn, expected []expectedSocketOption) {
+	for _, e := range expected {
+		value := getSocketOption(t, conn, e.level, e.opt)
+		// the kernel doubles the buffer sizes for its bookkeeping
+		if value != e.value && !(e.orMoreValue && value >= e.value) {
+			t.Errorf("Expected %v of %v to be %v, but got %v", e.name, side, e.value, value)
+		}
+	}
+}
+
+func TestTcpProxy_socket_options(t *testing.T) {
+	server := NewTcpServer("127.0.0.1:19501")
+	server.Name = "TcpTargetServer"
+	server.CbData = func(data []byte, addr net.Addr) {
+		server.Respond(data, addr)
+	}
+	server.Start()
+	defer server.Stop()
+
+	noDelay := false
+	proxy := NewTcpProxy("127.0.0.1:19500", "127.0.0.1:19501")
+	proxy.SourceSocketOptions = &SocketOptions{KeepAliveCount: 3, NoDelay: &noDelay, ReceiveBuffer: 65536, Dscp: 46, Ttl: 42}
+	proxy.TargetSocketOptions = &SocketOptions{KeepAliveCount: 5, SendBuffer: 65536, Dscp: 10, Ttl: 17}
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:19500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.mutex.Lock()
+	var target *TcpClient
+	for _, client := range proxy.clients {
+		target = client.client
+	}
+	proxy.mutex.Unlock()
+	proxy.server.mutex.Lock()
+	var source StreamConn
+	for _, serverConn := range proxy.server.connections {
+		source = serverConn.rawConn
+	}
+	proxy.server.mutex.Unlock()
+	if source == nil || target == nil {
+		t.Fatal("Expected a session on the proxy")
+	}
+
+	checkSocketOptions(t, "source", source.(syscall.Conn), []expectedSocketOption{
+		{"TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 3, false},
+		{"TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0, false},
+		{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, 65536, true},
+		{"IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS, 46 << 2, false},
+		{"IP_TTL", syscall.IPPROTO_IP, syscall.IP_TTL, 42, false},
+	})
+	checkSocketOptions(t, "target", target.rawConn.(syscall.Conn), []expectedSocketOption{
+		{"TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 5, false},
+		{"TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1, false},
+		{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, 65536, true},
+		{"IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS, 10 << 2, false},
+		{"IP_TTL", syscall.IPPROTO_IP, syscall.IP_TTL, 17, false},
+	})
+}
+
+func TestUdpProxy_socket_options(t *testing.T) {
+	server := NewUdpServer("[::1]:15601")
+	server.Name = "UdpTestServer"
+	server.Consumer = func(data []byte, addr *net.UDPAddr) {
+		server.Respond(data, addr)
+	}
+	server.Start()
+	defer server.Stop()
+
+	proxy := NewUdpProxy("127.0.0.1:15600", "[::1]:15601")
+	proxy.SetName("UdpTestProxy")
+	proxy.SourceSocketOptions = &SocketOptions{ReceiveBuffer: 65536, Dscp: 46}
+	proxy.TargetSocketOptions = &SocketOptions{SendBuffer: 65536, Dscp: 10, Ttl: 17}
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn, err := net.Dial("udp", "127.0.0.1:15600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, maxDatagramSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	checkSocketOptions(t, "source", proxy.server.conn, []expectedSocketOption{
+		{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, 65536, true},
+		{"IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS, 46 << 2, false},
+	})
+	for _, client := range proxy.clients {
+		for _, targetConn := range client.client.conns {
+			checkSocketOptions(t, "target", targetConn, []expectedSocketOption{
+				{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, 65536, true},
+				{"IPV6_TCLASS", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 10 << 2, false},
+				{"IPV6_UNICAST_HOPS", syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, 17, false},
+			})
+		}
+	}
+}
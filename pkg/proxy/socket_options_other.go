@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+)
+
+// setSocketOptions only supports the options that Go sets itself on other platforms than Linux
+func (o *SocketOptions) setSocketOptions(string, uintptr) error {
+	if o.ReceiveBuffer > 0 || o.SendBuffer > 0 || o.Mark > 0 || o.Dscp > 0 || o.Ttl > 0 {
+		return errors.New("socket options are only supported on Linux")
+	}
+	return nil
+}
+
+// setKeepAliveCount is not supported on other platforms than Linux
+func (o *SocketOptions) setKeepAliveCount(uintptr) error {
+	return errors.New("the keepalive count is only supported on Linux")
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSocketOptions(t *testing.T) {
+	options, err := ParseSocketOptions("keepalive=30s,keepalive-count=4,nodelay=false,rcvbuf=65536,sndbuf=131072,dscp=46,ttl=64,mark=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.KeepAlive != 30*time.Second || options.KeepAliveCount != 4 || options.NoDelay == nil || *options.NoDelay ||
+		options.ReceiveBuffer != 65536 || options.SendBuffer != 131072 || options.Dscp != 46 || options.Ttl != 64 || options.Mark != 7 {
+		t.Errorf("Unexpected options: %+v", options)
+	}
+	// a negative keepalive disables it
+	if options, err := ParseSocketOptions("keepalive=-5s"); err != nil || options.KeepAlive != -5*time.Second {
+		t.Errorf("Expected a negative keepalive, but got %+v and %v", options, err)
+	}
+	for _, spec := range []string{"keepalive", "keepalive=soon", "dscp=64", "ttl=-1", "nodelay=maybe", "window=1"} {
+		if _, err := ParseSocketOptions(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	socks5Version = 0x05
+	// socksAuthVersion is the version of the username/password authentication (RFC 1929)
+	socksAuthVersion = 0x01
+
+	socksMethodNoAuth       = 0x00
+	socksMethodPassword     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdUdpAssociate = 0x03
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyConnectionRefused   = 0x05
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddrNotSupported    = 0x08
+)
+
+var errSocksAddrNotSupported = errors.New("SOCKS address type not supported")
+
+// socksAddr is a destination requested by a SOCKS client, either with an IP or a domain name
+type socksAddr struct {
+	ip   net.IP
+	name string
+	port int
+}
+
+func (a socksAddr) host() string {
+	if a.ip != nil {
+		return a.ip.String()
+	}
+	return a.name
+}
+
+func (a socksAddr) String() string {
+	return net.JoinHostPort(a.host(), strconv.Itoa(a.port))
+}
+
+// negotiateSocksAuth reads the greeting of a client and selects an authentication method.
+// With users, the client has to authenticate with username and password and the username is returned.
+func negotiateSocksAuth(rw io.ReadWriter, users map[string]string) (user string, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(rw, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksMethodNoAuth)
+	if len(users) > 0 {
+		method = socksMethodPassword
+	}
+	supported := false
+	for _, m := range methods {
+		supported = supported || m == method
+	}
+	if !supported {
+		_, _ = rw.Write([]byte{socks5Version, socksMethodNoAcceptable})
+		return "", errors.New("no acceptable SOCKS authentication method")
+	}
+	if _, err = rw.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodNoAuth {
+		return "", nil
+	}
+	return readSocksCredentials(rw, users)
+}
+
+// readSocksCredentials performs the username/password authentication of RFC 1929
+func readSocksCredentials(rw io.ReadWriter, users map[string]string) (string, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(rw, version); err != nil {
+		return "", err
+	}
+	if version[0] != socksAuthVersion {
+		return "", fmt.Errorf("unsupported SOCKS authentication version %d", version[0])
+	}
+	user, err := readSocksString(rw)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSocksString(rw)
+	if err != nil {
+		return "", err
+	}
+	expected, ok := users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		_, _ = rw.Write([]byte{socksAuthVersion, 0x01})
+		return "", fmt.Errorf("invalid SOCKS credentials for user %q", user)
+	}
+	_, err = rw.Write([]byte{socksAuthVersion, 0x00})
+	return user, err
+}
+
+// readSocksString reads a string that is prefixed with its length in one byte
+func readSocksString(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	value := make([]byte, length[0])
+	if _, err := io.ReadFull(r, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// readSocksRequest reads the command and destination of a client request
+func readSocksRequest(r io.Reader) (cmd byte, dst socksAddr, err error) {
+	header := make([]byte, 3)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return 0, dst, err
+	}
+	if header[0] != socks5Version {
+		return 0, dst, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	dst, err = readSocksAddr(r)
+	return header[1], dst, err
+}
+
+// readSocksAddr reads an address type, the address and the port
+func readSocksAddr(r io.Reader) (addr socksAddr, err error) {
+	addrType := make([]byte, 1)
+	if _, err = io.ReadFull(r, addrType); err != nil {
+		return addr, err
+	}
+	switch addrType[0] {
+	case socksAddrIPv4:
+		addr.ip = make(net.IP, net.IPv4len)
+		_, err = io.ReadFull(r, addr.ip)
+	case socksAddrIPv6:
+		addr.ip = make(net.IP, net.IPv6len)
+		_, err = io.ReadFull(r, addr.ip)
+	case socksAddrDomain:
+		addr.name, err = readSocksString(r)
+	default:
+		return addr, errSocksAddrNotSupported
+	}
+	if err != nil {
+		return addr, err
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(r, port); err != nil {
+		return addr, err
+	}
+	addr.port = int(binary.BigEndian.Uint16(port))
+	return addr, nil
+}
+
+// appendSocksAddr appends the address type, IP and port of a TCP or UDP address.
+// Other addresses are encoded as 0.0.0.0:0.
+func appendSocksAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append(append(b, socksAddrIPv4), ip4...)
+	} else {
+		b = append(append(b, socksAddrIPv6), ip.To16()...)
+	}
+	return appendUint16(b, port)
+}
+
+// writeSocksReply sends the reply to a request with the bound address
+func writeSocksReply(w io.Writer, reply byte, bound net.Addr) error {
+	_, err := w.Write(appendSocksAddr([]byte{socks5Version, reply, 0x00}, bound))
+	return err
+}
+
+// socksDialReply returns the reply for a failed connection attempt
+func socksDialReply(err error) byte {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return socksReplyConnectionRefused
+	}
+	return socksReplyHostUnreachable
+}
+
+// parseSocksDatagram splits a UDP datagram of a client into its destination and payload.
+// Fragmented datagrams are not supported.
+func parseSocksDatagram(data []byte) (dst socksAddr, payload []byte, err error) {
+	if len(data) < 4 {
+		return dst, nil, errors.New("SOCKS datagram too short")
+	}
+	if data[2] != 0 {
+		return dst, nil, errors.New("fragmented SOCKS datagrams are not supported")
+	}
+	r := &byteReader{data: data[3:]}
+	if dst, err = readSocksAddr(r); err != nil {
+		return dst, nil, err
+	}
+	return dst, r.data, nil
+}
+
+// byteReader reads from a byte slice and keeps the remaining bytes accessible
+type byteReader struct {
+	data []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
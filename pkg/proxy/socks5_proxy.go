@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Socks5Proxy is a SOCKS5 proxy (RFC 1928), which connects to the destinations requested by its clients.
+// It supports CONNECT for TCP and UDP ASSOCIATE for UDP.
+type Socks5Proxy struct {
+	name string
+	// Users requires clients to authenticate with one of these usernames and passwords (RFC 1929), if not empty
+	Users map[string]string
+	// Rules restrict the allowed destinations. The first matching rule decides, destinations without
+	// a matching rule are denied. Without rules, all destinations are allowed.
+	// Domain names are resolved before the rules are checked and the resolved IP is used for connecting.
+	Rules []*DestinationRule
+	// HandshakeTimeout is the maximum time for the authentication and the request of a client
+	HandshakeTimeout time.Duration
+	// DialTimeout is the timeout for resolving and connecting to a destination
+	DialTimeout time.Duration
+	// MaxUdpDestinations limits the number of destinations of a UDP association, if greater than zero.
+	// Datagrams to further destinations are dropped, until others expired.
+	MaxUdpDestinations int
+	// UdpIdleTimeout closes the socket to a destination of a UDP association, if no datagram was relayed
+	// in any direction for this duration. It is checked with a granularity of a quarter of the timeout.
+	UdpIdleTimeout time.Duration
+	// SourceSocketOptions tune the sockets of the clients, if set
+	SourceSocketOptions *SocketOptions
+	// TargetSocketOptions tune the sockets to the destinations, if set
+	TargetSocketOptions *SocketOptions
+	server              *TcpServer
+	clients             relayClients
+	verbose             bool
+	statsPrinter        *StatsPrinter
+	Proxy
+}
+
+// NewSocks5Proxy creates a new SOCKS5 proxy with:
+// sourceAddress: The address to listen on
+func NewSocks5Proxy(sourceAddress string) (p *Socks5Proxy) {
+	p = new(Socks5Proxy)
+	p.server = NewTcpServer(sourceAddress)
+	p.server.Handler = p.handle
+	p.server.CbRejected = p.sourceRejected
+	p.HandshakeTimeout = 10 * time.Second
+	p.DialTimeout = 10 * time.Second
+	p.MaxUdpDestinations = 64
+	p.UdpIdleTimeout = 2 * time.Minute
+	p.statsPrinter = NewStatsPrinter()
+	p.SetName("Socks5Proxy")
+	return
+}
+
+// SetName sets the name of the proxy for identification in logs
+func (p *Socks5Proxy) SetName(name string) {
+	p.name = name
+	p.server.Name = name + "_Server"
+}
+
+// SetVerbose enables logging of every request
+func (p *Socks5Proxy) SetVerbose(verbose bool) {
+	p.verbose = verbose
+}
+
+// Start listening for clients
+func (p *Socks5Proxy) Start() {
+	p.clients.start()
+	p.server.SocketOptions = p.SourceSocketOptions
+	p.server.Start()
+}
+
+// Stop listening and close all connections and associations
+func (p *Socks5Proxy) Stop() {
+	// cancel pending connection attempts, so that the server does not wait for them
+	p.clients.stop()
+	p.server.Stop()
+}
+
+// Shutdown stops accepting new clients and waits for the existing connections and UDP associations to finish,
+// until the context is done. The remaining ones are closed then. It returns the number of finished and closed connections.
+func (p *Socks5Proxy) Shutdown(ctx context.Context) (drained, killed int) {
+	return drainAndStop(ctx, p.name, p.server, p.Stop)
+}
+
+func (p *Socks5Proxy) sourceRejected(net.Addr, string) {
+	p.statsPrinter.NewMessage(p.name + ":rejected")
+}
+
+// handle reads the authentication and the request of a client and serves it
+func (p *Socks5Proxy) handle(conn StreamConn, addr net.Addr, _ []byte) {
+	if p.HandshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(p.HandshakeTimeout)); err != nil {
+			log.Printf("%v - Could not set handshake deadline for %v: %v", p.name, addr, err)
+			return
+		}
+	}
+	user, err := negotiateSocksAuth(conn, p.Users)
+	if err != nil {
+		log.Printf("%v - Rejected %v: %v", p.name, addr, err)
+		p.statsPrinter.NewMessage(p.name + ":rejected")
+		return
+	}
+	cmd, dst, err := readSocksRequest(conn)
+	if err != nil {
+		log.Printf("%v - Could not read request of %v: %v", p.name, addr, err)
+		if errors.Is(err, errSocksAddrNotSupported) {
+			p.reply(conn, addr, socksReplyAddrNotSupported, nil)
+		}
+		return
+	}
+	if p.verbose {
+		log.Printf("%v - Request %d of %v (user %q) for %v", p.name, cmd, addr, user, dst)
+	}
+
+	switch cmd {
+	case socksCmdConnect:
+		p.connect(conn, addr, dst)
+	case socksCmdUdpAssociate:
+		p.associate(conn, addr, dst)
+	default:
+		log.Printf("%v - Unsupported command %d of %v", p.name, cmd, addr)
+		p.reply(conn, addr, socksReplyCommandNotSupported, nil)
+	}
+}
+
+// reply sends a reply to the client and clears the handshake deadline on success
+func (p *Socks5Proxy) reply(conn StreamConn, addr net.Addr, reply byte, bound net.Addr) bool {
+	err := writeSocksReply(conn, reply, bound)
+	if err == nil && reply == socksReplySucceeded {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		log.Printf("%v - Could not reply to %v: %v", p.name, addr, err)
+		return false
+	}
+	return true
+}
+
+// resolve checks the destination against the rules and returns the address to connect to
+func (p *Socks5Proxy) resolve(dst socksAddr) (string, byte) {
+	target, err := resolveDestination(dst.host(), dst.port, p.Rules, p.DialTimeout)
+	if errors.Is(err, errDestinationNotAllowed) {
+		log.Printf("%v - Destination %v not allowed", p.name, dst)
+		return "", socksReplyNotAllowed
+	}
+	if err != nil {
+		log.Printf("%v - Could not resolve %v: %v", p.name, dst, err)
+		return "", socksReplyHostUnreachable
+	}
+	return target, socksReplySucceeded
+}
+
+// connect relays the client connection to the destination with a TcpClient
+func (p *Socks5Proxy) connect(conn StreamConn, addr net.Addr, dst socksAddr) {
+	target, reply := p.resolve(dst)
+	if reply != socksReplySucceeded {
+		p.statsPrinter.NewMessage(p.name + ":rejected")
+		p.reply(conn, addr, reply, nil)
+		return
+	}
+
+	client := NewTcpClient(target)
+	client.Name = p.name + "_Client"
+	client.Verbose = p.verbose
+	client.HalfClose = true
+	client.DialTimeout = p.DialTimeout
+	client.SocketOptions = p.TargetSocketOptions
+	client.CbConnected = func() {
+		if !p.reply(conn, addr, socksReplySucceeded, client.conn.LocalAddr()) {
+			// aborts the relaying
+			_ = conn.Close()
+		}
+	}
+	client.CbConnectFailed = func(err error) {
+		log.Printf("%v - Could not connect %v to %v: %v", p.name, addr, dst, err)
+		p.reply(conn, addr, socksDialReply(err), nil)
+	}
+	if !p.clients.add(client) {
+		return
+	}
+	defer p.clients.remove(client)
+	client.Relay(conn, nil)
+}
+
+// associate relays UDP datagrams of the client, as long as the control connection is open.
+// dst is the address the client expects to send datagrams from, see newSocksAssociation.
+func (p *Socks5Proxy) associate(conn StreamConn, addr net.Addr, dst socksAddr) {
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		p.reply(conn, addr, socksReplyGeneralFailure, nil)
+		return
+	}
+	udpConn, err := p.SourceSocketOptions.listenUdp((&net.UDPAddr{IP: localAddr.IP}).String())
+	if err != nil {
+		log.Printf("%v - Could not listen for UDP datagrams of %v: %v", p.name, addr, err)
+		p.reply(conn, addr, socksReplyGeneralFailure, nil)
+		return
+	}
+	association := newSocksAssociation(p, udpConn, addr, dst)
+	go association.receive()
+	if !p.reply(conn, addr, socksReplySucceeded, udpConn.LocalAddr()) {
+		association.close()
+		return
+	}
+	log.Printf("%v - Start relaying UDP datagrams of %v on %v", p.name, addr, udpConn.LocalAddr())
+
+	// the association ends with the control connection
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil && !isClosedConnError(err) {
+		log.Printf("%v - Control connection of %v failed: %v", p.name, addr, err)
+	}
+	association.close()
+	log.Printf("%v - Stop relaying UDP datagrams of %v", p.name, addr)
+}
+
+// socksAssociation relays UDP datagrams between a client and its destinations with one socket per destination
+type socksAssociation struct {
+	proxy *Socks5Proxy
+	conn  *net.UDPConn
+	// clientIP is the IP of the control connection. Datagrams from other IPs are dropped.
+	clientIP net.IP
+	// clientPort is the port the client announced in its request, or zero. Datagrams from other ports are dropped.
+	clientPort int
+	clientAddr *net.UDPAddr
+	targets    map[string]*socksDestination
+	// receivers are the goroutines that receive the datagrams of the destinations
+	receivers sync.WaitGroup
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+// socksDestination is the socket to a destination of an association and the time it was last used
+type socksDestination struct {
+	conn     *net.UDPConn
+	lastUsed time.Time
+}
+
+// newSocksAssociation creates an association for the client of the control connection from addr.
+// The request of the client may announce the address it sends datagrams from. Its port restricts the
+// datagrams, if it announces the IP of the control connection. Other IPs are not used, as a client
+// behind a NAT only knows its private address, so the datagrams arrive from the public one.
+func newSocksAssociation(p *Socks5Proxy, conn *net.UDPConn, addr net.Addr, dst socksAddr) *socksAssociation {
+	a := &socksAssociation{proxy: p, conn: conn, targets: map[string]*socksDestination{}, done: make(chan struct{})}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		a.clientIP = tcpAddr.IP
+		if dst.ip != nil && dst.ip.Equal(tcpAddr.IP) {
+			a.clientPort = dst.port
+		}
+	}
+	return a
+}
+
+func (a *socksAssociation) receive() {
+	defer close(a.done)
+	p := a.proxy
+	data := make([]byte, maxDatagramSize)
+	nextExpiry := time.Now().Add(p.UdpIdleTimeout / 4)
+	for {
+		if p.UdpIdleTimeout > 0 {
+			// interrupt receiving regularly to expire idle destinations
+			if err := a.conn.SetReadDeadline(nextExpiry); err != nil {
+				log.Printf("%v - Could not set UDP read deadline: %v", p.name, err)
+				return
+			}
+		}
+		n, addr, err := a.conn.ReadFromUDP(data)
+		if now := time.Now(); p.UdpIdleTimeout > 0 && !now.Before(nextExpiry) {
+			a.expire(now)
+			nextExpiry = now.Add(p.UdpIdleTimeout / 4)
+		}
+		var netErr net.Error
+		if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		}
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Printf("%v - Could not receive UDP datagram: %v", p.name, err)
+			}
+			return
+		}
+		if (a.clientIP != nil && !a.clientIP.Equal(addr.IP)) || (a.clientPort != 0 && a.clientPort != addr.Port) {
+			if p.verbose {
+				log.Printf("%v - Dropping UDP datagram of unknown source %v", p.name, addr)
+			}
+			continue
+		}
+		dst, payload, err := parseSocksDatagram(data[:n])
+		if err != nil {
+			log.Printf("%v - Dropping UDP datagram of %v: %v", p.name, addr, err)
+			continue
+		}
+		a.mutex.Lock()
+		a.clientAddr = addr
+		a.mutex.Unlock()
+		if destination := a.target(dst); destination != nil {
+			if _, err := destination.conn.Write(payload); err != nil {
+				log.Printf("%v - Could not send UDP datagram to %v: %v", p.name, dst, err)
+			}
+		}
+	}
+}
+
+// target returns the socket to a destination and creates it on first use.
+// It returns nil, if the destination is not allowed, the limit of destinations is reached or
+// the socket could not be created.
+func (a *socksAssociation) target(dst socksAddr) *socksDestination {
+	a.mutex.Lock()
+	destination, ok := a.targets[dst.String()]
+	if ok {
+		destination.lastUsed = time.Now()
+	}
+	count := len(a.targets)
+	a.mutex.Unlock()
+	if ok {
+		return destination
+	}
+	if a.proxy.MaxUdpDestinations > 0 && count >= a.proxy.MaxUdpDestinations {
+		log.Printf("%v - Dropping UDP datagram to %v: limit of %d destinations reached", a.proxy.name, dst, a.proxy.MaxUdpDestinations)
+		a.proxy.statsPrinter.NewMessage(a.proxy.name + ":rejected")
+		return nil
+	}
+	target, reply := a.proxy.resolve(dst)
+	if reply != socksReplySucceeded {
+		a.proxy.statsPrinter.NewMessage(a.proxy.name + ":rejected")
+		return nil
+	}
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err == nil {
+		// a connected socket without a local address, so that the kernel chooses the route
+		destination = &socksDestination{lastUsed: time.Now()}
+		destination.conn, err = a.proxy.TargetSocketOptions.dialUdp(nil, targetAddr)
+	}
+	if err != nil {
+		log.Printf("%v - Dropping UDP datagram to %v: %v", a.proxy.name, dst, err)
+		a.proxy.statsPrinter.NewMessage(a.proxy.name + ":rejected")
+		return nil
+	}
+	a.receivers.Add(1)
+	go a.receiveFrom(destination, targetAddr)
+	a.mutex.Lock()
+	a.targets[dst.String()] = destination
+	a.mutex.Unlock()
+	return destination
+}
+
+// receiveFrom passes the datagrams of a destination to the client, until its socket is closed
+func (a *socksAssociation) receiveFrom(destination *socksDestination, from *net.UDPAddr) {
+	defer a.receivers.Done()
+	data := make([]byte, maxDatagramSize)
+	for {
+		n, err := destination.conn.Read(data)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			// an earlier datagram was refused, the destination may still respond to later ones
+			continue
+		}
+		if err != nil {
+			if !isClosedConnError(err) {
+				log.Printf("%v - Could not receive UDP datagram from %v: %v", a.proxy.name, from, err)
+			}
+			return
+		}
+		a.respond(destination, from, data[:n])
+	}
+}
+
+// expire closes the sockets of the destinations that were idle for longer than the UdpIdleTimeout
+func (a *socksAssociation) expire(now time.Time) {
+	timeout := a.proxy.UdpIdleTimeout
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for key, destination := range a.targets {
+		if now.Sub(destination.lastUsed) >= timeout {
+			delete(a.targets, key)
+			a.closeDestination(destination)
+		}
+	}
+}
+
+// closeDestination closes the socket of a destination, which ends its receiver
+func (a *socksAssociation) closeDestination(destination *socksDestination) {
+	if err := destination.conn.Close(); err != nil && !isClosedConnError(err) {
+		log.Printf("%v - Could not close UDP connection: %v", a.proxy.name, err)
+	}
+}
+
+// respond sends a datagram of a destination to the client
+func (a *socksAssociation) respond(destination *socksDestination, from *net.UDPAddr, data []byte) {
+	a.mutex.Lock()
+	destination.lastUsed = time.Now()
+	clientAddr := a.clientAddr
+	a.mutex.Unlock()
+	packet := appendSocksAddr([]byte{0x00, 0x00, 0x00}, from)
+	packet = append(packet, data...)
+	if _, err := a.conn.WriteToUDP(packet, clientAddr); err != nil && !isClosedConnError(err) {
+		log.Printf("%v - Could not send UDP datagram to %v: %v", a.proxy.name, clientAddr, err)
+	}
+}
+
+// close stops receiving and all clients of the destinations
+func (a *socksAssociation) close() {
+	if err := a.conn.Close(); err != nil && !isClosedConnError(err) {
+		log.Printf("%v - Could not close UDP connection: %v", a.proxy.name, err)
+	}
+	<-a.done
+	a.mutex.Lock()
+	for _, destination := range a.targets {
+		a.closeDestination(destination)
+	}
+	a.mutex.Unlock()
+	a.receivers.Wait()
+}
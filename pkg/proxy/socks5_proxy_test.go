@@ -0,0 +1,388 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSocksTestEchoServer(address string) *TcpServer {
+	server := NewTcpServer(address)
+	server.Name = "TcpTargetServer"
+	server.CbData = func(data []byte, addr net.Addr) {
+		server.Respond(data, addr)
+	}
+	server.Start()
+	return server
+}
+
+// socksHandshake authenticates with the given methods and sends a request for a domain destination.
+// It returns the reply code and the bound address of the reply, or the rejected method or status.
+func socksHandshake(t *testing.T, conn net.Conn, user, password string, cmd byte, host string, port int) (byte, *net.UDPAddr) {
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	method := byte(socksMethodNoAuth)
+	if user != "" {
+		method = socksMethodPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, 2)
+	if _, err := io.ReadFull(conn, res); err != nil {
+		t.Fatal(err)
+	}
+	if res[1] != method {
+		return res[1], nil
+	}
+	if user != "" {
+		auth := append([]byte{socksAuthVersion, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, res); err != nil {
+			t.Fatal(err)
+		}
+		if res[1] != 0 {
+			return res[1], nil
+		}
+	}
+
+	req := append([]byte{socks5Version, cmd, 0, socksAddrDomain, byte(len(host))}, host...)
+	req = appendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != socksAddrIPv4 {
+		t.Fatalf("Expected an IPv4 bound address, but got type %d", reply[3])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return reply[1], &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+}
+
+func socksEcho(t *testing.T, conn net.Conn, message string) {
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != message {
+		t.Errorf("Expected %v, but got %s", message, res)
+	}
+}
+
+func TestSocks5Proxy_connect(t *testing.T) {
+	server := newSocksTestEchoServer(":18501")
+	defer server.Stop()
+
+	proxy := NewSocks5Proxy("localhost:18500")
+	proxy.SetName("Socks5TestProxy")
+	proxy.Start()
+	defer proxy.Stop()
+
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		conn, err := net.Dial("tcp", "localhost:18500")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, _ := socksHandshake(t, conn, "", "", socksCmdConnect, host, 18501)
+		if reply != socksReplySucceeded {
+			t.Fatalf("Expected CONNECT to %v to succeed, but got reply %d", host, reply)
+		}
+		socksEcho(t, conn, "Hello "+host)
+		_ = conn.Close()
+	}
+
+	conn, err := net.Dial("tcp", "localhost:18500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if reply, _ := socksHandshake(t, conn, "", "", socksCmdConnect, "127.0.0.1", 18502); reply != socksReplyConnectionRefused {
+		t.Errorf("Expected connection refused, but got reply %d", reply)
+	}
+}
+
+func TestSocks5Proxy_authentication(t *testing.T) {
+	server := newSocksTestEchoServer(":18601")
+	defer server.Stop()
+
+	proxy := NewSocks5Proxy("localhost:18600")
+	proxy.SetName("Socks5TestProxy")
+	proxy.Users = map[string]string{"alice": "secret"}
+	proxy.Start()
+	defer proxy.Stop()
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		expected byte
+	}{
+		{"No authentication", "", "", socksMethodNoAcceptable},
+		{"Wrong password", "alice", "wrong", 0x01},
+		{"Unknown user", "bob", "secret", 0x01},
+		{"Valid credentials", "alice", "secret", socksReplySucceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", "localhost:18600")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+			reply, _ := socksHandshake(t, conn, test.user, test.password, socksCmdConnect, "127.0.0.1", 18601)
+			if reply != test.expected {
+				t.Fatalf("Expected %d, but got %d", test.expected, reply)
+			}
+			if reply == socksReplySucceeded {
+				socksEcho(t, conn, "Hello")
+			}
+		})
+	}
+}
+
+func TestSocks5Proxy_rules(t *testing.T) {
+	server := newSocksTestEchoServer(":18701")
+	defer server.Stop()
+
+	proxy := NewSocks5Proxy("localhost:18700")
+	proxy.SetName("Socks5TestProxy")
+	for _, spec := range []string{"deny localhost:18701", "allow 127.0.0.0/8:18701", "deny *"} {
+		rule, err := ParseDestinationRule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.Rules = append(proxy.Rules, rule)
+	}
+	proxy.Start()
+	defer proxy.Stop()
+
+	tests := []struct {
+		host     string
+		port     int
+		expected byte
+	}{
+		{"127.0.0.1", 18701, socksReplySucceeded},
+		{"localhost", 18701, socksReplyNotAllowed},
+		{"127.0.0.1", 18702, socksReplyNotAllowed},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", "localhost:18700")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, _ := socksHandshake(t, conn, "", "", socksCmdConnect, test.host, test.port)
+		if reply != test.expected {
+			t.Errorf("Expected reply %d for %v:%d, but got %d", test.expected, test.host, test.port, reply)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestSocks5Proxy_udpAssociate(t *testing.T) {
+	server := NewUdpServer("127.0.0.1:18801")
+	server.Name = "UdpTargetServer"
+	server.Consumer = func(data []byte, addr *net.UDPAddr) {
+		server.Respond(data, addr)
+	}
+	server.Start()
+	defer server.Stop()
+
+	proxy := NewSocks5Proxy("127.0.0.1:18800")
+	proxy.SetName("Socks5TestProxy")
+	proxy.Start()
+	defer proxy.Stop()
+
+	control, err := net.Dial("tcp", "127.0.0.1:18800")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = control.Close() }()
+	reply, bound := socksHandshake(t, control, "", "", socksCmdUdpAssociate, "0.0.0.0", 0)
+	if reply != socksReplySucceeded {
+		t.Fatalf("Expected UDP ASSOCIATE to succeed, but got reply %d", reply)
+	}
+
+	conn, err := net.DialUDP("udp", nil, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	target := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 18801}
+	header := appendSocksAddr([]byte{0, 0, 0}, target)
+	if _, err := conn.Write(append(header, "Hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, maxDatagramSize)
+	n, err := conn.Read(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(header, "Hello"...)
+	if !bytes.Equal(res[:n], expected) {
+		t.Errorf("Expected %v, but got %v", expected, res[:n])
+	}
+
+	// the association ends with the control connection
+	_ = control.Close()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := conn.Write(append(header, "Again"...)); err == nil {
+		if n, err := conn.Read(res); err == nil {
+			t.Errorf("Expected no response after the association ended, but got %v", res[:n])
+		}
+	}
+}
+
+func TestParseDestinationRule(t *testing.T) {
+	tests := []struct {
+		spec  string
+		allow bool
+		host  string
+		port  int
+	}{
+		{"allow 10.0.0.0/8", true, "10.0.0.0/8", 0},
+		{"deny *.example.com:25", false, "*.example.com", 25},
+		{"allow [::1]:80", true, "::1", 80},
+		{"allow ::1", true, "::1", 0},
+		{"allow db:*", true, "db", 0},
+	}
+	for _, test := range tests {
+		rule, err := ParseDestinationRule(test.spec)
+		if err != nil {
+			t.Errorf("Could not parse %v: %v", test.spec, err)
+			continue
+		}
+		if rule.Allow != test.allow || rule.Host != test.host || rule.Port != test.port {
+			t.Errorf("Expected %v %v:%v for %v, but got %+v", test.allow, test.host, test.port, test.spec, rule)
+		}
+	}
+	for _, spec := range []string{"", "permit db", "allow db:http", "allow db:0", "allow"} {
+		if _, err := ParseDestinationRule(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestSocks5Proxy_udpDestinationLimits(t *testing.T) {
+	for _, port := range []int{18851, 18852} {
+		server := NewUdpServer("127.0.0.1:" + strconv.Itoa(port))
+		server.Name = "UdpTargetServer"
+		server.Consumer = func(data []byte, addr *net.UDPAddr) {
+			server.Respond(data, addr)
+		}
+		server.Start()
+		defer server.Stop()
+	}
+
+	proxy := NewSocks5Proxy("127.0.0.1:18850")
+	proxy.SetName("Socks5TestProxy")
+	proxy.MaxUdpDestinations = 1
+	proxy.UdpIdleTimeout = 200 * time.Millisecond
+	proxy.Start()
+	defer proxy.Stop()
+
+	control, err := net.Dial("tcp", "127.0.0.1:18850")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = control.Close() }()
+	reply, bound := socksHandshake(t, control, "", "", socksCmdUdpAssociate, "0.0.0.0", 0)
+	if reply != socksReplySucceeded {
+		t.Fatalf("Expected UDP ASSOCIATE to succeed, but got reply %d", reply)
+	}
+	conn, err := net.DialUDP("udp", nil, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// send returns true, if the destination echoed the datagram
+	send := func(port int, wait time.Duration) bool {
+		header := appendSocksAddr([]byte{0, 0, 0}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if _, err := conn.Write(append(header, "Hello"...)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(wait))
+		res := make([]byte, maxDatagramSize)
+		n, err := conn.Read(res)
+		if isTimeout(err) {
+			return false
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Equal(res[:n], append(header, "Hello"...))
+	}
+	if !send(18851, time.Second) {
+		t.Fatal("Expected a response of the first destination")
+	}
+	if send(18852, 100*time.Millisecond) {
+		t.Error("Expected datagrams to a second destination to be dropped")
+	}
+	// the first destination expires without datagrams
+	time.Sleep(400 * time.Millisecond)
+	if !send(18852, time.Second) {
+		t.Error("Expected a response of the second destination after the first one expired")
+	}
+}
+
+func TestSocks5Proxy_udpDestinationRoute(t *testing.T) {
+	proxy := NewSocks5Proxy("127.0.0.1:0")
+	proxy.SetName("Socks5TestProxy")
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	association := newSocksAssociation(proxy, conn, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, socksAddr{ip: net.IPv4zero})
+	go association.receive()
+	defer association.close()
+
+	// a documentation address is not in the network of any interface and only reachable through a gateway
+	dst := socksAddr{ip: net.IPv4(198, 51, 100, 1), port: 9}
+	probe, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst.ip, Port: dst.port})
+	if err != nil {
+		t.Skipf("No route to %v: %v", dst, err)
+	}
+	_ = probe.Close()
+	destination := association.target(dst)
+	if destination == nil {
+		t.Fatalf("Expected a socket to %v", dst)
+	}
+	if remote := destination.conn.RemoteAddr().String(); remote != dst.String() {
+		t.Errorf("Expected a socket connected to %v, but got %v", dst, remote)
+	}
+}
+
+func TestSocks5Proxy_udpAssociateClientAddress(t *testing.T) {
+	proxy := NewSocks5Proxy("127.0.0.1:0")
+	control := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	tests := []struct {
+		name     string
+		dst      socksAddr
+		expected int
+	}{
+		{"Unknown", socksAddr{ip: net.IPv4zero}, 0},
+		{"Same IP", socksAddr{ip: net.IPv4(192, 0, 2, 1), port: 5000}, 5000},
+		// behind a NAT, the datagrams arrive from another address
+		{"Private IP", socksAddr{ip: net.IPv4(10, 0, 0, 1), port: 5000}, 0},
+	}
+	for _, test := range tests {
+		association := newSocksAssociation(proxy, nil, control, test.dst)
+		if !association.clientIP.Equal(control.IP) || association.clientPort != test.expected {
+			t.Errorf("%v: Expected datagrams from %v:%d, but got %v:%d",
+				test.name, control.IP, test.expected, association.clientIP, association.clientPort)
+		}
+	}
+}
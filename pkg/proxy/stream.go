@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// unixAddressPrefix marks addresses of Unix domain sockets, like unix:/var/run/docker.sock.
+// On Linux, names starting with @ are in the abstract namespace, like unix:@name.
+const unixAddressPrefix = "unix:"
+
+// streamNetwork splits an address into its network, either tcp or unix, and the address within the network
+func streamNetwork(address string) (network, addr string) {
+	if strings.HasPrefix(address, unixAddressPrefix) {
+		return "unix", strings.TrimPrefix(address, unixAddressPrefix)
+	}
+	return "tcp", address
+}
+
+// listenStream listens on a TCP address or a Unix socket. A stale socket file, which is left over
+// from a process that did not stop cleanly, is removed first. The socket file is removed again,
+// when the listener is closed. The socket options are applied, if set.
+func listenStream(address string, options *SocketOptions) (net.Listener, error) {
+	network, addr := streamNetwork(address)
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	return options.listen(network, addr)
+}
+
+// dialStream connects to a TCP address or a Unix socket with a dialer that was created by the socket options
+func dialStream(ctx context.Context, dialer *net.Dialer, options *SocketOptions, address string) (StreamConn, error) {
+	network, addr := streamNetwork(address)
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := options.configure(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn.(StreamConn), nil
+}
+
+// removeStaleSocket removes the socket file at the path, if no one accepts connections on it anymore
+func removeStaleSocket(path string) error {
+	if strings.HasPrefix(path, "@") {
+		// abstract sockets have no file
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%v is in use", path)
+	}
+	return os.Remove(path)
+}
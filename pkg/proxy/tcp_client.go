@@ -1,22 +1,65 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 type TcpClient struct {
-	Name           string
-	CbData         func([]byte)
-	CbConnected    func()
+	Name            string
+	CbData          func([]byte)
+	CbConnected     func()
+	CbConnectFailed func(err error)
+	CbReadClosed    func()
+	// CbReadFailed is called, if the connection was aborted with an error, for example by a reset of the target
+	CbReadFailed   func(err error)
 	CbDisconnected func()
-	Verbose        bool
-	address        string
-	conn           *net.TCPConn
-	running        bool
-	mutex          sync.Mutex
-	receivers      sync.WaitGroup
+	// CbRelayed is called with the number of relayed bytes per direction, when relaying
+	CbRelayed func(n int64, fromSource bool)
+	// CbRelayEnded is called, when relaying in one direction ended, with a nil error at the end of the stream
+	CbRelayEnded func(fromSource bool, err error)
+	// RelayReportInterval interrupts relaying regularly to call CbRelayed while data is flowing.
+	// Without it, CbRelayed is only called when a direction was closed.
+	RelayReportInterval time.Duration
+	Verbose             bool
+	// HalfClose keeps the connection open for writing after the remote side closed its write direction,
+	// until CloseWrite or Stop is called
+	HalfClose      bool
+	DialTimeout    time.Duration
+	DialRetries    int
+	DialBackoff    time.Duration
+	DialMaxBackoff time.Duration
+	// ProxyProtocol sends a PROXY protocol header with ProxySourceAddr and ProxyDestinationAddr after connecting
+	ProxyProtocol ProxyProtocolVersion
+	// ProxySourceAddr is the address of the original client. Without it, a v2 header marks the connection
+	// as not proxied (LOCAL), like the connections of health checks.
+	ProxySourceAddr net.Addr
+	// ProxyDestinationAddr is the address the original client connected to
+	ProxyDestinationAddr net.Addr
+	// TlsConfig connects to the target with TLS, if set. Without a ServerName, the host of the address is used,
+	// which requires a ServerName for Unix sockets.
+	TlsConfig *tls.Config
+	// SocketOptions tune the connection to the target, if set
+	SocketOptions *SocketOptions
+	// address is a TCP address or a Unix socket, like unix:/path/to.sock or unix:@abstract
+	address string
+	// conn is either the TCP or Unix connection or the TLS connection on top of it
+	conn        StreamConn
+	rawConn     StreamConn
+	source      StreamConn
+	running     bool
+	writeClosed chan struct{}
+	closeOnce   sync.Once
+	cancelDial  context.CancelFunc
+	mutex       sync.Mutex
+	receivers   sync.WaitGroup
 }
 
 func NewTcpClient(address string) (c *TcpClient) {
@@ -24,39 +67,254 @@ func NewTcpClient(address string) (c *TcpClient) {
 	c.Name = "TcpClient"
 	c.CbData = func([]byte) {}
 	c.CbConnected = func() {}
+	c.CbConnectFailed = func(error) {}
+	c.CbReadClosed = func() {}
+	c.CbReadFailed = func(error) {}
 	c.CbDisconnected = func() {}
+	c.CbRelayed = func(int64, bool) {}
+	c.CbRelayEnded = func(bool, error) {}
+	c.DialTimeout = 10 * time.Second
+	c.DialBackoff = 100 * time.Millisecond
+	c.DialMaxBackoff = 5 * time.Second
 	c.address = address
 	return
 }
 
+// Start connecting to the target and receive data in a separate goroutine
 func (c *TcpClient) Start() {
+	if !c.connect(nil) {
+		return
+	}
+
+	// the callback may already send data, so it must not be called with the mutex locked
+	c.CbConnected()
+	log.Printf("%v - Start Receiving: %v -> %v", c.Name, c.conn.LocalAddr(), c.conn.RemoteAddr())
+	go c.receive()
+}
+
+// Relay connects to the target and copies data between the source connection and the target
+// directly, without passing it to CbData. On Linux, this allows the kernel to splice the data.
+// The prefix is data that was already read from the source and is sent first.
+// It blocks until both directions are closed.
+func (c *TcpClient) Relay(source StreamConn, prefix []byte) {
+	if !c.connect(source) {
+		return
+	}
+
+	c.CbConnected()
+	if len(prefix) > 0 {
+		c.Send(prefix)
+		c.CbRelayed(int64(len(prefix)), true)
+	}
+	log.Printf("%v - Start relaying: %v -> %v", c.Name, source.RemoteAddr(), c.conn.RemoteAddr())
+
+	done := make(chan struct{})
+	go func() {
+		c.copyStream(c.conn, source, true)
+		close(done)
+	}()
+	c.copyStream(source, c.conn, false)
+	<-done
+	c.receivers.Done()
+
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	c.running = false
+	c.mutex.Unlock()
+	c.closeConns()
 
-	if c.running {
+	c.CbDisconnected()
+	log.Printf("%v - Stop relaying: %v -> %v", c.Name, source.RemoteAddr(), c.conn.RemoteAddr())
+}
+
+// copyStream copies all data from src to dst. The end of the stream is forwarded with HalfClose,
+// in all other cases both connections are closed to abort the opposite direction as well.
+func (c *TcpClient) copyStream(dst, src StreamConn, fromSource bool) {
+	err := c.copyAll(dst, src, fromSource)
+	c.CbRelayEnded(fromSource, err)
+	if err == nil && c.HalfClose {
+		if err := dst.CloseWrite(); err != nil && !isClosedConnError(err) {
+			log.Printf("%v - Could not close write direction of %v: %v", c.Name, dst.RemoteAddr(), err)
+		}
 		return
 	}
+	if err != nil && !isClosedConnError(err) {
+		log.Printf("%v - Could not relay data: %v -> %v: %v", c.Name, src.RemoteAddr(), dst.RemoteAddr(), err)
+		if !fromSource {
+			c.CbReadFailed(err)
+		}
+	}
+	c.closeConns()
+}
+
+// copyAll copies data from src to dst until the end of src is reached.
+// With a RelayReportInterval, a read deadline interrupts the copying regularly to report the progress.
+func (c *TcpClient) copyAll(dst, src StreamConn, fromSource bool) error {
+	for {
+		if c.RelayReportInterval > 0 {
+			if err := src.SetReadDeadline(time.Now().Add(c.RelayReportInterval)); err != nil {
+				return err
+			}
+		}
+		n, err := copyConn(dst, src)
+		if n > 0 {
+			c.CbRelayed(n, fromSource)
+		}
+		var netErr net.Error
+		if err != nil && c.RelayReportInterval > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		}
+		return err
+	}
+}
+
+// copyConn copies from src to dst, using dst.ReadFrom if possible, which splices two TCP connections on Linux
+func copyConn(dst, src StreamConn) (int64, error) {
+	if readerFrom, ok := dst.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(src)
+	}
+	return io.Copy(dst, src)
+}
+
+// closeConns closes the target connection and, when relaying, the source connection
+func (c *TcpClient) closeConns() {
+	var conns []StreamConn
+	if c.rawConn != nil {
+		// close the TCP connection directly, to not wait for a TLS close notification
+		conns = append(conns, c.rawConn)
+	}
+	if c.source != nil {
+		conns = append(conns, c.source)
+	}
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil && !isClosedConnError(err) {
+			log.Printf("%v - Could not close connection: %v", c.Name, err)
+		}
+	}
+}
+
+// connect dials the target and registers the connection.
+// It returns false, if the client is already running or the connection could not be established.
+func (c *TcpClient) connect(source StreamConn) bool {
+	c.mutex.Lock()
+	if c.running {
+		c.mutex.Unlock()
+		return false
+	}
 	c.running = true
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelDial = cancel
+	c.mutex.Unlock()
 
-	addr, err := net.ResolveTCPAddr("tcp", c.address)
-	if err != nil {
-		log.Printf("%v - Could resolve address %v: %v", c.Name, c.address, err)
-		return
+	rawConn, err := c.dial(ctx)
+	cancel()
+	if err == nil && c.ProxyProtocol != ProxyProtocolNone {
+		err = c.writeProxyHeader(rawConn)
+	}
+	conn := rawConn
+	if err == nil && c.TlsConfig != nil {
+		conn, err = c.tlsHandshake(rawConn)
 	}
 
-	c.conn, err = net.DialTCP("tcp", nil, addr)
+	c.mutex.Lock()
 	if err != nil {
-		log.Printf("%v - Could not connect to %v: %v", c.Name, c.address, err)
-		return
+		// a canceled dial is not a failure of the target
+		stopped := !c.running
+		c.running = false
+		c.mutex.Unlock()
+		if !stopped {
+			c.CbConnectFailed(err)
+		}
+		return false
+	}
+	if !c.running {
+		// stopped while dialing
+		c.mutex.Unlock()
+		if err := conn.Close(); err != nil {
+			log.Printf("%v - Could not close client connection: %v", c.Name, err)
+		}
+		return false
 	}
+	c.conn = conn
+	c.rawConn = rawConn
+	c.source = source
+	c.writeClosed = make(chan struct{})
+	c.closeOnce = sync.Once{}
+	c.receivers.Add(1)
+	c.mutex.Unlock()
+	return true
+}
+
+// dial tries to connect to the target address, retrying with an exponential backoff
+// until DialRetries is exhausted or the context is canceled
+func (c *TcpClient) dial(ctx context.Context) (StreamConn, error) {
+	dialer := c.SocketOptions.dialer(c.DialTimeout)
+	backoff := c.DialBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := dialStream(ctx, dialer, c.SocketOptions, c.address)
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("%v - Could not connect to %v (attempt %d/%d): %v", c.Name, c.address, attempt+1, c.DialRetries+1, err)
+		if attempt >= c.DialRetries {
+			return nil, err
+		}
 
-	if err := c.conn.SetReadBuffer(maxDatagramSize); err != nil {
-		log.Printf("%v - Could not set read buffer: %v", c.Name, err)
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("dial canceled")
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if c.DialMaxBackoff > 0 && backoff > c.DialMaxBackoff {
+			backoff = c.DialMaxBackoff
+		}
 	}
+}
 
-	c.CbConnected()
-	log.Printf("%v - Start Receiving: %v -> %v", c.Name, c.conn.LocalAddr(), c.conn.RemoteAddr())
-	go c.receive()
+// tlsHandshake wraps the connection with TLS and closes it on failure
+func (c *TcpClient) tlsHandshake(conn StreamConn) (StreamConn, error) {
+	config := c.TlsConfig
+	if network, _ := streamNetwork(c.address); network == "tcp" && config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(c.address)
+		if err != nil {
+			host = c.address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	var err error
+	if c.DialTimeout > 0 {
+		err = tlsConn.SetDeadline(time.Now().Add(c.DialTimeout))
+	}
+	if err == nil {
+		err = tlsConn.Handshake()
+	}
+	if err == nil {
+		err = tlsConn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		if err := conn.Close(); err != nil {
+			log.Printf("%v - Could not close client connection: %v", c.Name, err)
+		}
+		return nil, fmt.Errorf("TLS handshake with %v failed: %w", c.address, err)
+	}
+	return tlsConn, nil
+}
+
+// writeProxyHeader sends the PROXY protocol header and closes the connection on failure
+func (c *TcpClient) writeProxyHeader(conn StreamConn) error {
+	header, err := proxyHeader(c.ProxyProtocol, c.ProxySourceAddr, c.ProxyDestinationAddr)
+	if err == nil {
+		_, err = conn.Write(header)
+	}
+	if err != nil {
+		if err := conn.Close(); err != nil {
+			log.Printf("%v - Could not close client connection: %v", c.Name, err)
+		}
+		return fmt.Errorf("could not send PROXY protocol header: %w", err)
+	}
+	return nil
 }
 
 func (c *TcpClient) Stop() {
@@ -68,10 +326,39 @@ func (c *TcpClient) Stop() {
 	}
 	c.running = false
 
-	if err := c.conn.Close(); err != nil {
-		log.Printf("%v - Could not close client connection: %v", c.Name, err)
+	if c.conn == nil {
+		// still dialing
+		c.cancelDial()
+		return
 	}
+
+	c.closeConns()
+	c.markWriteClosed()
+
+	// receivers need the mutex to finish
+	c.mutex.Unlock()
 	c.receivers.Wait()
+	c.mutex.Lock()
+}
+
+// CloseWrite closes the write direction of the connection.
+// With HalfClose, the connection is closed completely as soon as the remote side closed its write direction as well.
+func (c *TcpClient) CloseWrite() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.running || c.conn == nil {
+		return
+	}
+	if err := c.conn.CloseWrite(); err != nil {
+		log.Printf("%v - Could not close write direction: %v", c.Name, err)
+	}
+	c.markWriteClosed()
+}
+
+// markWriteClosed releases a receiver that waits for the write direction to be closed
+func (c *TcpClient) markWriteClosed() {
+	c.closeOnce.Do(func() { close(c.writeClosed) })
 }
 
 func (c *TcpClient) isRunning() bool {
@@ -81,8 +368,6 @@ func (c *TcpClient) isRunning() bool {
 }
 
 func (c *TcpClient) receive() {
-
-	c.receivers.Add(1)
 	defer c.receivers.Done()
 
 	firstData := true
@@ -90,7 +375,16 @@ func (c *TcpClient) receive() {
 	for c.isRunning() {
 		n, err := c.conn.Read(data)
 		if err != nil {
+			if c.HalfClose && errors.Is(err, io.EOF) {
+				log.Printf("%v - Remote closed write direction: %v -> %v", c.Name, c.conn.LocalAddr(), c.conn.RemoteAddr())
+				c.CbReadClosed()
+				<-c.writeClosed
+				break
+			}
 			log.Printf("%v - Could not receive data: %v -> %v: %s", c.Name, c.conn.LocalAddr(), c.conn.RemoteAddr(), err)
+			if !errors.Is(err, io.EOF) && !isClosedConnError(err) {
+				c.CbReadFailed(err)
+			}
 			break
 		}
 		if c.Verbose && firstData {
@@ -107,7 +401,7 @@ func (c *TcpClient) receive() {
 func (c *TcpClient) Send(data []byte) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if c.running {
+	if c.running && c.conn != nil {
 		if _, err := c.conn.Write(data); err != nil {
 			log.Printf("%v - Could not send: %v -> %v: %s", c.Name, c.conn.LocalAddr(), c.conn.RemoteAddr(), err)
 		}
@@ -1,44 +1,321 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
+	"math"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type tcpProxyClient struct {
+	// lastActivity and the byte counters are accessed atomically and must be 64-bit aligned
+	lastActivity    int64
+	bytesFromSource int64
+	bytesFromTarget int64
+	gotFirstByte    int32
+	// reported is set, as soon as the outcome of the connection was reported to the balancer
+	reported   int32
+	started    time.Time
+	done       chan struct{}
+	doneOnce   sync.Once
+	record     *SessionRecord
+	reasonOnce sync.Once
+	finishOnce sync.Once
 	sourceAddr net.Addr
-	client     *TcpClient
-	parent     *TcpProxy
+	balancer   *Balancer
+	target     *Target
+	// trial is set for the trial connection of a half-open circuit breaker
+	trial       bool
+	client      *TcpClient
+	parent      *TcpProxy
+	isConnected bool
+	closed      bool
+	sourceEOF   bool
+	pending     [][]byte
+	pendingSize int
+	mutex       sync.Mutex
+	cond        *sync.Cond
 }
 
-func newTcpProxyClient(sourceAddr net.Addr, parent *TcpProxy) (c *tcpProxyClient) {
+func newTcpProxyClient(sourceAddr net.Addr, balancer *Balancer, target *Target, trial bool, parent *TcpProxy) (c *tcpProxyClient) {
 	c = new(tcpProxyClient)
 	c.sourceAddr = sourceAddr
+	c.balancer = balancer
+	c.trial = trial
+	c.target = target
 	c.parent = parent
-	c.client = NewTcpClient(parent.targetAddress)
+	c.cond = sync.NewCond(&c.mutex)
+	c.record = newSessionRecord(parent.name, "tcp")
+	c.record.Source = sourceAddr.String()
+	c.record.Target = target.Address
+	c.started = c.record.Start
+	c.lastActivity = c.started.UnixNano()
+	c.done = make(chan struct{})
+	c.client = NewTcpClient(target.Address)
 	c.client.Name = parent.name + "_Client"
 	c.client.CbData = c.newData
 	c.client.CbConnected = c.connected
+	c.client.CbConnectFailed = c.connectFailed
+	c.client.CbReadClosed = c.targetReadClosed
+	c.client.CbReadFailed = c.targetReadFailed
 	c.client.CbDisconnected = c.disconnected
 	c.client.Verbose = parent.verbose
+	c.client.HalfClose = parent.halfClose
+	c.client.DialTimeout = parent.DialTimeout
+	c.client.DialRetries = parent.DialRetries
+	c.client.DialBackoff = parent.DialBackoff
+	c.client.DialMaxBackoff = parent.DialMaxBackoff
+	c.client.CbRelayed = c.relayed
+	c.client.CbRelayEnded = c.relayEnded
+	c.client.RelayReportInterval = parent.activityCheckInterval()
+	c.client.ProxyProtocol = parent.ProxyProtocol
+	c.client.TlsConfig = parent.TargetTlsConfig
+	c.client.SocketOptions = parent.TargetSocketOptions
+	c.client.ProxySourceAddr = sourceAddr
+	c.client.ProxyDestinationAddr = parent.server.LocalAddr(sourceAddr)
+	if c.client.ProxyDestinationAddr != nil {
+		c.record.SourceLocal = c.client.ProxyDestinationAddr.String()
+	}
+	return
+}
+
+func (c *tcpProxyClient) relayed(n int64, fromSource bool) {
+	c.touch(n, fromSource)
+	if !fromSource {
+		c.reportSuccess()
+	}
+}
+
+// reportSuccess closes the circuit breaker of the target, once the target sent data or the session ended without an error
+func (c *tcpProxyClient) reportSuccess() {
+	if atomic.CompareAndSwapInt32(&c.reported, 0, 1) && c.balancer.ReportSuccess(c.target) {
+		log.Printf("%v - Circuit breaker of %v closed", c.parent.name, c.target.Address)
+	}
+}
+
+// reportFailure counts a failure of the target, unless the target already sent data
+func (c *tcpProxyClient) reportFailure(err error) {
+	if atomic.CompareAndSwapInt32(&c.reported, 0, 1) && c.balancer.ReportFailure(c.target) {
+		log.Printf("%v - Circuit breaker of %v opened for %v: %v", c.parent.name, c.target.Address, c.balancer.CoolDown, err)
+	}
+}
+
+// relayEnded records the side that closed a relayed session first
+func (c *tcpProxyClient) relayEnded(fromSource bool, err error) {
+	side := ClosedByTarget
+	if fromSource {
+		side = ClosedBySource
+	}
+	if err == nil {
+		c.setCloseReason(side+" closed", side)
+	} else if !isClosedConnError(err) {
+		// closed connections are aborted by the proxy, which already set the reason
+		c.setCloseReason(side+" failed: "+err.Error(), side)
+	}
+}
+
+// touch records the transfer of n bytes on the session
+func (c *tcpProxyClient) touch(n int64, fromSource bool) {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	if fromSource {
+		atomic.AddInt64(&c.bytesFromSource, n)
+		atomic.StoreInt32(&c.gotFirstByte, 1)
+	} else {
+		atomic.AddInt64(&c.bytesFromTarget, n)
+	}
+}
+
+// setCloseReason records why the session was closed. Only the first reason is kept.
+func (c *tcpProxyClient) setCloseReason(reason, closedBy string) {
+	c.reasonOnce.Do(func() {
+		c.record.CloseReason = reason
+		c.record.ClosedBy = closedBy
+	})
+}
+
+// finish writes the record of the session to the access log, after both directions ended
+func (c *tcpProxyClient) finish() {
+	c.finishOnce.Do(func() {
+		c.setCloseReason("closed", ClosedByProxy)
+		c.mutex.Lock()
+		record := *c.record
+		c.mutex.Unlock()
+		record.End = time.Now()
+		record.BytesFromSource = atomic.LoadInt64(&c.bytesFromSource)
+		record.BytesFromTarget = atomic.LoadInt64(&c.bytesFromTarget)
+		c.parent.AccessLog.Log(&record)
+	})
+}
+
+// watch closes the session, as soon as one of the configured timeouts expired
+func (c *tcpProxyClient) watch() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-timer.C:
+		}
+		reason, next := c.checkTimeouts(time.Now())
+		if reason != "" {
+			log.Printf("%v - Closing %v -> %v: %v", c.parent.name, c.sourceAddr, c.target.Address, reason)
+			c.setCloseReason(reason, ClosedByProxy)
+			c.parent.server.Close(c.sourceAddr, false)
+			c.Stop()
+			return
+		}
+		timer.Reset(next)
+	}
+}
+
+// checkTimeouts returns the reason for an expired timeout or the duration until the next timeout expires
+func (c *tcpProxyClient) checkTimeouts(now time.Time) (reason string, next time.Duration) {
+	p := c.parent
+	next = math.MaxInt64
+	check := func(timeout time.Duration, since time.Time, name string) {
+		remaining := since.Add(timeout).Sub(now)
+		if remaining <= 0 {
+			reason = name + " of " + timeout.String() + " expired"
+		} else if remaining < next {
+			next = remaining
+		}
+	}
+	if p.MaxLifetime > 0 {
+		check(p.MaxLifetime, c.started, "max lifetime")
+	}
+	if p.FirstByteTimeout > 0 && atomic.LoadInt32(&c.gotFirstByte) == 0 {
+		check(p.FirstByteTimeout, c.started, "first-byte timeout")
+	}
+	if p.IdleTimeout > 0 {
+		check(p.IdleTimeout, time.Unix(0, atomic.LoadInt64(&c.lastActivity)), "idle timeout")
+	}
 	return
 }
 
 func (c *tcpProxyClient) newData(data []byte) {
+	c.touch(int64(len(data)), false)
+	c.reportSuccess()
+	if c.parent.CbTargetData != nil {
+		c.parent.CbTargetData(data, c.sourceAddr)
+	}
 	c.parent.server.Respond(data, c.sourceAddr)
 }
 
 func (c *tcpProxyClient) send(data []byte) {
-	c.client.Send(data)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for !c.isConnected && !c.closed {
+		if c.pendingSize+len(data) <= c.parent.PreConnectBufferSize {
+			// the data slice is reused by the server, so it has to be copied
+			c.pending = append(c.pending, append([]byte{}, data...))
+			c.pendingSize += len(data)
+			return
+		}
+		switch c.parent.PreConnectOverflowPolicy {
+		case OverflowBlock:
+			c.cond.Wait()
+		case OverflowDrop:
+			log.Printf("%v - Pre-connect buffer of %v is full, dropping %d bytes", c.parent.name, c.sourceAddr, len(data))
+			return
+		case OverflowDisconnect:
+			log.Printf("%v - Pre-connect buffer of %v is full, closing connection", c.parent.name, c.sourceAddr)
+			c.setCloseReason("pre-connect buffer full", ClosedByProxy)
+			c.closed = true
+			c.cond.Broadcast()
+			go c.parent.server.Close(c.sourceAddr, c.parent.RejectWithReset)
+			return
+		}
+	}
+
+	if c.isConnected {
+		c.client.Send(data)
+	}
 }
 
 func (c *tcpProxyClient) connected() {
-	c.parent.addClient(c)
+	if c.parent.verbose {
+		log.Printf("%v - Connected TCP Proxy client: %v -> %v", c.parent.name, c.sourceAddr, c.client.conn.RemoteAddr())
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.record.TargetLocal = c.client.conn.LocalAddr().String()
+	for _, data := range c.pending {
+		c.client.Send(data)
+	}
+	if c.parent.verbose && c.pendingSize > 0 {
+		log.Printf("%v - Flushed %d pre-connect bytes from %v", c.parent.name, c.pendingSize, c.sourceAddr)
+	}
+	c.pending = nil
+	c.pendingSize = 0
+	c.isConnected = true
+	c.cond.Broadcast()
+	if c.sourceEOF {
+		c.client.CloseWrite()
+	}
+}
+
+// sourceReadClosed forwards the end of the source data stream to the target, after all pending data was sent
+func (c *tcpProxyClient) sourceReadClosed() {
+	c.setCloseReason("source closed", ClosedBySource)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sourceEOF = true
+	if c.isConnected {
+		c.client.CloseWrite()
+	}
+}
+
+// targetReadClosed forwards the end of the target data stream to the source
+func (c *tcpProxyClient) targetReadClosed() {
+	c.setCloseReason("target closed", ClosedByTarget)
+	c.parent.server.CloseWrite(c.sourceAddr)
+}
+
+// targetReadFailed counts a reset of the target before it sent any data as a failure
+func (c *tcpProxyClient) targetReadFailed(err error) {
+	c.setCloseReason("target failed: "+err.Error(), ClosedByTarget)
+	c.reportFailure(err)
+}
+
+func (c *tcpProxyClient) connectFailed(err error) {
+	log.Printf("%v - Giving up connecting %v to %v: %v", c.parent.name, c.sourceAddr, c.target.Address, err)
+	c.reportFailure(err)
+	c.setCloseReason("target unreachable: "+err.Error(), ClosedByProxy)
+	c.close()
+	c.parent.removeClient(c)
+	c.parent.server.Close(c.sourceAddr, c.parent.RejectWithReset)
+	c.finish()
+}
+
+// close discards all pending data and releases blocked senders and the watcher
+func (c *tcpProxyClient) close() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+		c.balancer.Release(c.target, c.trial)
+	})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	c.pending = nil
+	c.pendingSize = 0
+	c.cond.Broadcast()
 }
 
 func (c *tcpProxyClient) disconnected() {
+	c.setCloseReason("target closed", ClosedByTarget)
+	c.reportSuccess()
+	c.close()
 	c.parent.removeClient(c)
+	// close the source after all pending data was sent
+	c.parent.server.CloseWrite(c.sourceAddr)
+	c.finish()
 }
 
 func (c *tcpProxyClient) Start() {
@@ -46,18 +323,100 @@ func (c *tcpProxyClient) Start() {
 }
 
 func (c *tcpProxyClient) Stop() {
+	c.close()
 	c.client.Stop()
+	// a client that is stopped while dialing does not report its disconnect
+	c.parent.removeClient(c)
+	c.finish()
 }
 
 // TcpProxy is a proxy for TCP connections
 type TcpProxy struct {
 	name          string
 	sourceAddress string
-	targetAddress string
+	// Balancer chooses the target for each new source connection
+	Balancer *Balancer
+	// CertificateRouter chooses the balancer by the identity of the client certificate of a source, if set.
+	// The common name and all subject alternative names are matched. It requires TLS with client certificates.
+	CertificateRouter *Router
+	// SniRouter chooses the balancer by the server name that a source requested with TLS SNI, if set.
+	// Without TlsConfig, TLS is not terminated and the ClientHello is forwarded to the target.
+	// The CertificateRouter takes precedence.
+	SniRouter *Router
+	// ProtocolRouter chooses the balancer by the protocol that the Sniffer detected, like ProtocolTls, if set.
+	// The default route is used for unknown protocols. The CertificateRouter and SniRouter take precedence.
+	ProtocolRouter *Router
+	// Sniffer detects the protocol for the ProtocolRouter. A default sniffer is used, if it is not set.
+	Sniffer *Sniffer
+	// HealthChecker excludes unhealthy targets, if set. It also checks the targets of the routers and
+	// uses the ProxyProtocol and TargetTlsConfig of the proxy.
+	HealthChecker *HealthChecker
 	server        *TcpServer
 	clients       map[string]*tcpProxyClient
 	mutex         sync.Mutex
 	verbose       bool
+	halfClose     bool
+	statsPrinter  *StatsPrinter
+	// DialTimeout is the timeout for a single connection attempt to the target
+	DialTimeout time.Duration
+	// DialRetries is the number of additional connection attempts, if the first one fails
+	DialRetries int
+	// DialBackoff is the initial wait time between connection attempts, doubled after each attempt
+	DialBackoff time.Duration
+	// DialMaxBackoff limits the wait time between connection attempts
+	DialMaxBackoff time.Duration
+	// ProxyProtocol sends a PROXY protocol header with the address of the source to the target
+	ProxyProtocol ProxyProtocolVersion
+	// AcceptProxyProtocol identifies sources by the address from their PROXY protocol header, if they send one.
+	// Any source can claim any address this way, so it should only be enabled if all sources are trusted proxies.
+	AcceptProxyProtocol bool
+	// RequireProxyProtocol rejects sources without a valid PROXY protocol header
+	RequireProxyProtocol bool
+	// ProxyHeaderTimeout is the maximum time to wait for the PROXY protocol header of a source
+	ProxyHeaderTimeout time.Duration
+	// TlsConfig terminates TLS from the sources, if set. The data is forwarded to the target in plaintext.
+	TlsConfig *tls.Config
+	// TlsHandshakeTimeout is the maximum time for the TLS handshake with a source
+	TlsHandshakeTimeout time.Duration
+	// TargetTlsConfig connects to the targets with TLS, if set
+	TargetTlsConfig *tls.Config
+	// RejectWithReset closes the source connection with a RST instead of a FIN, if the target is not reachable
+	RejectWithReset bool
+	// PreConnectBufferSize is the maximum number of bytes that are buffered per connection until the target is connected
+	PreConnectBufferSize int
+	// PreConnectOverflowPolicy defines what happens if the pre-connect buffer is full
+	PreConnectOverflowPolicy OverflowPolicy
+	// WriteQueueSize is the maximum number of pending chunks per source connection
+	WriteQueueSize int
+	// IdleTimeout closes a session, if no data was transferred in any direction for this duration.
+	// Without data callbacks, the activity is checked with a granularity of a quarter of the timeout.
+	IdleTimeout time.Duration
+	// FirstByteTimeout closes a session, if the source did not send any data within this duration after connecting
+	FirstByteTimeout time.Duration
+	// MaxLifetime closes a session after this duration, regardless of its activity
+	MaxLifetime time.Duration
+	// MaxConnections limits the number of concurrent sessions, if greater than zero
+	MaxConnections int
+	// MaxConnectionsPerIP limits the number of concurrent sessions per source IP, if greater than zero
+	MaxConnectionsPerIP int
+	// AcceptQueueSize is the number of sources that may wait for a free session, if a limit is reached.
+	// Further sources are rejected immediately.
+	AcceptQueueSize int
+	// AcceptQueueTimeout is the maximum time a source waits for a free session. Zero means no timeout.
+	AcceptQueueTimeout time.Duration
+	// WriteQueuePolicy defines what happens if a source does not consume data fast enough.
+	// With OverflowBlock, the target connection is not read until there is space in the queue again.
+	WriteQueuePolicy OverflowPolicy
+	// SourceSocketOptions tune the sockets of the sources, if set
+	SourceSocketOptions *SocketOptions
+	// TargetSocketOptions tune the sockets to the targets, if set
+	TargetSocketOptions *SocketOptions
+	// AccessLog records every closed session, if set
+	AccessLog *AccessLog
+	// CbSourceData is called with all data received from a source, if set
+	CbSourceData func(data []byte, sourceAddr net.Addr)
+	// CbTargetData is called with all data received from the target for a source, if set
+	CbTargetData func(data []byte, sourceAddr net.Addr)
 	Proxy
 }
 
@@ -65,14 +424,34 @@ type TcpProxy struct {
 // sourceAddress: The address to listen on
 // targetAddress: The address to proxy everything to
 func NewTcpProxy(sourceAddress, targetAddress string) (p *TcpProxy) {
+	return NewBalancedTcpProxy(sourceAddress, []*Target{NewTarget(targetAddress)})
+}
+
+// NewBalancedTcpProxy creates a new TCP proxy with:
+// sourceAddress: The address to listen on
+// targets: The targets to distribute the connections to
+func NewBalancedTcpProxy(sourceAddress string, targets []*Target) (p *TcpProxy) {
 	p = new(TcpProxy)
 	p.sourceAddress = sourceAddress
-	p.targetAddress = targetAddress
+	p.Balancer = NewBalancer(targets)
 	p.server = NewTcpServer(sourceAddress)
 	p.server.CbData = p.newDataFromSource
 	p.server.CbConnected = p.sourceConnected
+	p.server.CbReadClosed = p.sourceReadClosed
 	p.server.CbDisconnected = p.sourceDisconnected
+	p.server.CbRejected = p.sourceRejected
 	p.clients = map[string]*tcpProxyClient{}
+	p.statsPrinter = NewStatsPrinter()
+	p.DialTimeout = 10 * time.Second
+	p.DialBackoff = 100 * time.Millisecond
+	p.DialMaxBackoff = 5 * time.Second
+	p.PreConnectBufferSize = 64 * 1024
+	p.PreConnectOverflowPolicy = OverflowBlock
+	p.WriteQueueSize = p.server.WriteQueueSize
+	p.WriteQueuePolicy = p.server.WriteQueuePolicy
+	p.ProxyHeaderTimeout = p.server.ProxyHeaderTimeout
+	p.TlsHandshakeTimeout = p.server.TlsHandshakeTimeout
+	p.SetHalfClose(true)
 	p.SetName("TcpProxy")
 	return
 }
@@ -91,33 +470,183 @@ func (p *TcpProxy) SetVerbose(verbose bool) {
 	}
 }
 
-// Start listening for connections
+// SetHalfClose enables or disables forwarding of a closed write direction (FIN) from one side to the other.
+// If enabled, the opposite direction is relayed until it is closed as well.
+func (p *TcpProxy) SetHalfClose(halfClose bool) {
+	p.halfClose = halfClose
+	p.server.HalfClose = halfClose
+}
+
+// Start listening for connections.
+// If no data callbacks are set, the data is relayed directly between the connections (and spliced on Linux).
+// The pre-connect buffer is not used in this case, as the source is not read until the target is connected.
 func (p *TcpProxy) Start() {
+	if p.CbSourceData == nil && p.CbTargetData == nil {
+		p.server.Handler = p.relay
+	} else {
+		p.server.Handler = nil
+	}
+	p.server.WriteQueueSize = p.WriteQueueSize
+	p.server.WriteQueuePolicy = p.WriteQueuePolicy
+	p.server.MaxConnections = p.MaxConnections
+	p.server.MaxConnectionsPerIP = p.MaxConnectionsPerIP
+	p.server.AcceptQueueSize = p.AcceptQueueSize
+	p.server.AcceptQueueTimeout = p.AcceptQueueTimeout
+	p.server.AcceptProxyProtocol = p.AcceptProxyProtocol || p.RequireProxyProtocol
+	p.server.RequireProxyProtocol = p.RequireProxyProtocol
+	p.server.ProxyHeaderTimeout = p.ProxyHeaderTimeout
+	p.server.TlsConfig = p.TlsConfig
+	p.server.TlsHandshakeTimeout = p.TlsHandshakeTimeout
+	p.server.SocketOptions = p.SourceSocketOptions
+	p.server.ReadClientHello = p.SniRouter != nil && p.TlsConfig == nil
+	p.server.Sniffer = nil
+	if p.ProtocolRouter != nil {
+		if p.Sniffer == nil {
+			p.Sniffer = NewSniffer()
+		}
+		p.server.Sniffer = p.Sniffer
+	}
+	if p.HealthChecker != nil {
+		p.HealthChecker.ProxyProtocol = p.ProxyProtocol
+		p.HealthChecker.TlsConfig = p.TargetTlsConfig
+		// the targets of the routes are checked as well
+		for _, router := range []*Router{p.CertificateRouter, p.SniRouter, p.ProtocolRouter} {
+			if router != nil {
+				for _, balancer := range router.Balancers() {
+					p.HealthChecker.AddBalancer(balancer)
+				}
+			}
+		}
+		p.HealthChecker.Start()
+	}
 	p.server.Start()
 }
 
 // Stop listening for connections and stop all existing connections
 func (p *TcpProxy) Stop() {
-	p.server.Stop()
+	p.mutex.Lock()
 	for _, c := range p.clients {
-		c.Stop()
+		// the sessions end when the server closes the sources
+		c.setCloseReason("proxy stopped", ClosedByProxy)
+	}
+	p.mutex.Unlock()
+	p.server.Stop()
+	if p.HealthChecker != nil {
+		p.HealthChecker.Stop()
 	}
+	p.mutex.Lock()
+	clients := p.clients
 	p.clients = map[string]*tcpProxyClient{}
+	p.mutex.Unlock()
+	for _, c := range clients {
+		c.Stop()
+	}
+}
+
+// Shutdown stops accepting new connections and waits for the existing sessions to finish, until the context is done.
+// The remaining sessions are closed then. It returns the number of finished and closed sessions.
+func (p *TcpProxy) Shutdown(ctx context.Context) (drained, killed int) {
+	return drainAndStop(ctx, p.name, p.server, p.Stop)
 }
 
 func (p *TcpProxy) sourceConnected(addr net.Addr) {
-	client := newTcpProxyClient(addr, p)
-	client.Start()
+	balancer, ok := p.chooseBalancer(addr)
+	if !ok {
+		p.statsPrinter.NewMessage(p.name + ":rejected")
+		p.server.Close(addr, p.RejectWithReset)
+		return
+	}
+	target, trial, ok := balancer.Acquire(addr)
+	if !ok {
+		log.Printf("%v - No target available for %v", p.name, addr)
+		p.statsPrinter.NewMessage(p.name + ":rejected")
+		p.server.Close(addr, p.RejectWithReset)
+		return
+	}
+	client := newTcpProxyClient(addr, balancer, target, trial, p)
+	p.addClient(client)
+	if p.IdleTimeout > 0 || p.FirstByteTimeout > 0 || p.MaxLifetime > 0 {
+		go client.watch()
+	}
+	if p.server.Handler == nil {
+		// connect asynchronously to not block accepting further connections while retrying
+		go client.Start()
+	}
+}
+
+// chooseBalancer returns the balancer for the source, which depends on its client certificate
+// with a CertificateRouter, its requested server name with a SniRouter or its protocol with a ProtocolRouter
+func (p *TcpProxy) chooseBalancer(addr net.Addr) (*Balancer, bool) {
+	if p.CertificateRouter == nil && p.SniRouter == nil && p.ProtocolRouter == nil {
+		return p.Balancer, true
+	}
+	if p.CertificateRouter == nil {
+		router, kind, name := p.ProtocolRouter, "protocol", p.server.Protocol(addr)
+		if p.SniRouter != nil {
+			router, kind, name = p.SniRouter, "server name", p.server.ServerName(addr)
+		}
+		var names []string
+		if name != "" {
+			names = append(names, name)
+		}
+		balancer, ok := router.Route(names...)
+		if !ok {
+			log.Printf("%v - No route for %v with %v %q", p.name, addr, kind, name)
+		}
+		return balancer, ok
+	}
+	state := p.server.ConnectionState(addr)
+	if state == nil || len(state.PeerCertificates) == 0 {
+		log.Printf("%v - No client certificate for routing %v", p.name, addr)
+		return nil, false
+	}
+	identities := certificateIdentities(state.PeerCertificates[0])
+	balancer, ok := p.CertificateRouter.Route(identities...)
+	if !ok {
+		log.Printf("%v - No route for %v with client certificate %v", p.name, addr, identities)
+	}
+	return balancer, ok
+}
+
+// activityCheckInterval is the interval in which relayed connections report their activity
+func (p *TcpProxy) activityCheckInterval() (interval time.Duration) {
+	for _, timeout := range []time.Duration{p.IdleTimeout, p.FirstByteTimeout} {
+		if timeout > 0 && (interval == 0 || timeout/4 < interval) {
+			interval = timeout / 4
+		}
+	}
+	return
+}
+
+func (p *TcpProxy) relay(source StreamConn, sourceAddr net.Addr, prefix []byte) {
+	if client, ok := p.getClient(sourceAddr); ok {
+		client.client.Relay(source, prefix)
+	}
+}
+
+func (p *TcpProxy) sourceRejected(net.Addr, string) {
+	p.statsPrinter.NewMessage(p.name + ":rejected")
 }
 
 func (p *TcpProxy) sourceDisconnected(addr net.Addr) {
 	if client, ok := p.getClient(addr); ok {
+		client.setCloseReason("source closed", ClosedBySource)
 		client.Stop()
 	}
 }
 
+func (p *TcpProxy) sourceReadClosed(addr net.Addr) {
+	if client, ok := p.getClient(addr); ok {
+		client.sourceReadClosed()
+	}
+}
+
 func (p *TcpProxy) newDataFromSource(data []byte, sourceAddr net.Addr) {
+	if p.CbSourceData != nil {
+		p.CbSourceData(data, sourceAddr)
+	}
 	if client, ok := p.getClient(sourceAddr); ok {
+		client.touch(int64(len(data)), true)
 		client.send(data)
 	} else {
 		log.Printf("%v - Can not sent data: No client for %v known.", p.name, sourceAddr)
@@ -136,15 +665,20 @@ func (p *TcpProxy) addClient(client *tcpProxyClient) {
 	defer p.mutex.Unlock()
 	p.clients[client.sourceAddr.String()] = client
 	if p.verbose {
-		log.Printf("%v - Added TCP Proxy client: %v -> %v", p.name, client.sourceAddr, client.client.conn.RemoteAddr())
+		log.Printf("%v - Added TCP Proxy client: %v -> %v", p.name, client.sourceAddr, client.target.Address)
 	}
 }
 
 func (p *TcpProxy) removeClient(client *tcpProxyClient) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	delete(p.clients, client.sourceAddr.String())
+	key := client.sourceAddr.String()
+	if p.clients[key] != client {
+		// already removed, maybe the source address is used by a new connection
+		return
+	}
+	delete(p.clients, key)
 	if p.verbose {
-		log.Printf("%v - Removed TCP Proxy client: %v -> %v", p.name, client.sourceAddr, client.client.conn.RemoteAddr())
+		log.Printf("%v - Removed TCP Proxy client: %v -> %v", p.name, client.sourceAddr, client.target.Address)
 	}
 }
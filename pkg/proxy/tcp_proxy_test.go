@@ -1,9 +1,26 @@
 package proxy
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,64 +30,74 @@ func TestTcpProxy_roundtrip(t *testing.T) {
 	req := "R"
 	timesSend := 5
 
-	t.Run("Roundtrip", func(t *testing.T) {
-		proxy := NewTcpProxy(":16000", "localhost:16001")
-		proxy.Start()
-
-		server := NewTcpServer(":16001")
-		server.Name = "TcpTargetServer"
-		server.CbData = func(data []byte, addr net.Addr) {
-			log.Printf("Target: Got '%s'", string(data))
-			server.Respond(data, addr)
-			log.Printf("Target: Responded '%s'", string(data))
+	for _, withCallbacks := range []bool{false, true} {
+		name := "Roundtrip"
+		if withCallbacks {
+			name += "WithCallbacks"
 		}
-		server.Start()
+		t.Run(name, func(t *testing.T) {
+			proxy := NewTcpProxy(":16000", "localhost:16001")
+			if withCallbacks {
+				// data callbacks disable the direct relay
+				proxy.CbSourceData = func([]byte, net.Addr) {}
+			}
+			proxy.Start()
 
-		cRecv := make(chan bool, timesSend)
-		client := NewTcpClient("localhost:16000")
-		client.Name = "TcpSourceClient"
-		client.CbData = func(data []byte) {
-			log.Printf("Source: Got '%s'", string(data))
-			actualRes := string(data)
-			for i := 0; i < len(actualRes); i++ {
-				cRecv <- true
+			server := NewTcpServer(":16001")
+			server.Name = "TcpTargetServer"
+			server.CbData = func(data []byte, addr net.Addr) {
+				log.Printf("Target: Got '%s'", string(data))
+				server.Respond(data, addr)
+				log.Printf("Target: Responded '%s'", string(data))
 			}
-			log.Printf("Source: Consumed data")
-		}
-		client.Start()
+			server.Start()
 
-		for i := 0; i < timesSend; i++ {
-			log.Printf("Source: Send '%s'", req)
-			client.Send([]byte(req))
-		}
+			cRecv := make(chan bool, timesSend)
+			client := NewTcpClient("localhost:16000")
+			client.Name = "TcpSourceClient"
+			client.CbData = func(data []byte) {
+				log.Printf("Source: Got '%s'", string(data))
+				actualRes := string(data)
+				for i := 0; i < len(actualRes); i++ {
+					cRecv <- true
+				}
+				log.Printf("Source: Consumed data")
+			}
+			client.Start()
 
-		for i := 0; i < timesSend; i++ {
-			select {
-			case <-cRecv:
-			case <-time.After(1 * time.Second):
-				t.Error("Timed out")
+			for i := 0; i < timesSend; i++ {
+				log.Printf("Source: Send '%s'", req)
+				client.Send([]byte(req))
 			}
-		}
 
-		client.Stop()
+			for i := 0; i < timesSend; i++ {
+				select {
+				case <-cRecv:
+				case <-time.After(1 * time.Second):
+					t.Error("Timed out")
+				}
+			}
 
-		for i := 0; i < 5; i++ {
-			if len(server.connections) == 0 &&
-				len(proxy.server.connections) == 0 {
-				break
+			client.Stop()
+
+			for i := 0; i < 5; i++ {
+				if server.ActiveConnections() == 0 &&
+					proxy.server.ActiveConnections() == 0 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if server.ActiveConnections() > 0 {
+				t.Errorf("There are still %v active connections on the target server", server.ActiveConnections())
+			}
+			if proxy.server.ActiveConnections() > 0 {
+				t.Errorf("There are still %v active connections on the proxy server", proxy.server.ActiveConnections())
 			}
-			time.Sleep(10 * time.Millisecond)
-		}
-		if len(server.connections) > 0 {
-			t.Errorf("There are still %v active connections on the target server", len(server.connections))
-		}
-		if len(proxy.server.connections) > 0 {
-			t.Errorf("There are still %v active connections on the proxy server", len(proxy.server.connections))
-		}
 
-		server.Stop()
-		proxy.Stop()
-	})
+			server.Stop()
+			proxy.Stop()
+		})
+	}
 }
 
 func TestTcpProxy_multi_client(t *testing.T) {
@@ -125,20 +152,1855 @@ func TestTcpProxy_multi_client(t *testing.T) {
 		}
 
 		for i := 0; i < 5; i++ {
-			if len(server.connections) == 0 &&
-				len(proxy.server.connections) == 0 {
+			if server.ActiveConnections() == 0 &&
+				proxy.server.ActiveConnections() == 0 {
 				break
 			}
 			time.Sleep(10 * time.Millisecond)
 		}
-		if len(server.connections) > 0 {
-			t.Errorf("There are still %v active connections on the target server", len(server.connections))
+		if server.ActiveConnections() > 0 {
+			t.Errorf("There are still %v active connections on the target server", server.ActiveConnections())
+		}
+		if proxy.server.ActiveConnections() > 0 {
+			t.Errorf("There are still %v active connections on the proxy server", proxy.server.ActiveConnections())
+		}
+
+		server.Stop()
+		proxy.Stop()
+	})
+}
+
+func TestTcpProxy_unreachable_target(t *testing.T) {
+
+	t.Run("RejectSource", func(t *testing.T) {
+		proxy := NewTcpProxy(":16200", "localhost:16201")
+		proxy.DialRetries = 2
+		proxy.DialBackoff = 10 * time.Millisecond
+		proxy.RejectWithReset = true
+		proxy.Start()
+
+		cDisconnected := make(chan bool, 1)
+		client := NewTcpClient("localhost:16200")
+		client.Name = "TcpSourceClient"
+		client.CbDisconnected = func() {
+			cDisconnected <- true
+		}
+		client.Start()
+
+		select {
+		case <-cDisconnected:
+		case <-time.After(1 * time.Second):
+			t.Error("Source connection was not closed")
+		}
+
+		client.Stop()
+		proxy.Stop()
+	})
+}
+
+func TestTcpProxy_pre_connect_buffer(t *testing.T) {
+
+	t.Run("FlushAfterConnect", func(t *testing.T) {
+		proxy := NewTcpProxy(":16300", "localhost:16301")
+		proxy.DialRetries = 10
+		proxy.DialBackoff = 20 * time.Millisecond
+		proxy.DialMaxBackoff = 20 * time.Millisecond
+		// the pre-connect buffer is only used, if data callbacks are set
+		proxy.CbSourceData = func([]byte, net.Addr) {}
+		proxy.Start()
+
+		cRecv := make(chan string, 10)
+		client := NewTcpClient("localhost:16300")
+		client.Name = "TcpSourceClient"
+		client.CbData = func(data []byte) {
+			cRecv <- string(data)
+		}
+		client.Start()
+
+		// Send data while the target is not yet reachable
+		client.Send([]byte("A"))
+		client.Send([]byte("B"))
+		time.Sleep(50 * time.Millisecond)
+
+		server := NewTcpServer(":16301")
+		server.Name = "TcpTargetServer"
+		server.CbData = func(data []byte, addr net.Addr) {
+			server.Respond(data, addr)
 		}
-		if len(proxy.server.connections) > 0 {
-			t.Errorf("There are still %v active connections on the proxy server", len(proxy.server.connections))
+		server.Start()
+
+		received := ""
+		for received != "AB" {
+			select {
+			case data := <-cRecv:
+				received += data
+			case <-time.After(1 * time.Second):
+				t.Fatalf("Timed out, received: '%s'", received)
+			}
 		}
 
+		client.Stop()
+		for i := 0; i < 5 && server.ActiveConnections() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
 		server.Stop()
 		proxy.Stop()
 	})
 }
+
+func TestTcpProxy_half_close(t *testing.T) {
+
+	for _, withCallbacks := range []bool{false, true} {
+		name := "ResponseAfterCloseWrite"
+		if withCallbacks {
+			name += "WithCallbacks"
+		}
+		t.Run(name, func(t *testing.T) {
+			proxy := NewTcpProxy(":16400", "localhost:16401")
+			if withCallbacks {
+				// data callbacks disable the direct relay
+				proxy.CbSourceData = func([]byte, net.Addr) {}
+			}
+			proxy.Start()
+
+			var request []byte
+			server := NewTcpServer(":16401")
+			server.Name = "TcpTargetServer"
+			server.HalfClose = true
+			server.CbData = func(data []byte, addr net.Addr) {
+				request = append(request, data...)
+			}
+			server.CbReadClosed = func(addr net.Addr) {
+				// Respond only after the request was completed by the source
+				server.Respond([]byte("Response to "+string(request)), addr)
+				server.CloseWrite(addr)
+			}
+			server.Start()
+
+			addr, err := net.ResolveTCPAddr("tcp", "localhost:16400")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.DialTCP("tcp", nil, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write([]byte("Request")); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			response, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Error(err)
+			}
+			if string(response) != "Response to Request" {
+				t.Errorf("Expected to receive 'Response to Request', but got '%s'", string(response))
+			}
+			if err := conn.Close(); err != nil {
+				t.Error(err)
+			}
+
+			server.Stop()
+			proxy.Stop()
+		})
+	}
+}
+
+func BenchmarkTcpProxy_relay(b *testing.B) {
+	benchmarkTcpProxy(b, false, 16500)
+}
+
+func BenchmarkTcpProxy_callbacks(b *testing.B) {
+	benchmarkTcpProxy(b, true, 16600)
+}
+
+// benchmarkTcpProxy measures the throughput of a single connection through the proxy into a sink
+func benchmarkTcpProxy(b *testing.B, withCallbacks bool, port int) {
+	chunk := make([]byte, 32*1024)
+	sourceAddress := ":" + strconv.Itoa(port)
+	targetAddress := "localhost:" + strconv.Itoa(port+1)
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	proxy := NewTcpProxy(sourceAddress, targetAddress)
+	if withCallbacks {
+		proxy.CbSourceData = func([]byte, net.Addr) {}
+	}
+	proxy.Start()
+	defer proxy.Stop()
+
+	listener, err := net.Listen("tcp", targetAddress)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	received := make(chan int64)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, conn)
+		_ = conn.Close()
+		received <- n
+	}()
+
+	conn, err := net.Dial("tcp", "localhost"+sourceAddress)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		b.Fatal(err)
+	}
+	if n := <-received; n != int64(b.N*len(chunk)) {
+		b.Errorf("Expected %d bytes at the target, but got %d", b.N*len(chunk), n)
+	}
+	b.StopTimer()
+	_ = conn.Close()
+}
+
+func TestTcpProxy_slow_consumer(t *testing.T) {
+
+	t.Run("DisconnectSlowConsumer", func(t *testing.T) {
+		proxy := NewTcpProxy(":16700", "localhost:16701")
+		// the write queues are only used, if data callbacks are set
+		proxy.CbSourceData = func([]byte, net.Addr) {}
+		proxy.WriteQueueSize = 4
+		proxy.WriteQueuePolicy = OverflowDisconnect
+		proxy.Start()
+
+		flood := make([]byte, 64*1024)
+		server := NewTcpServer(":16701")
+		server.Name = "TcpTargetServer"
+		server.CbData = func(data []byte, addr net.Addr) {
+			if string(data) == "flood" {
+				go func() {
+					for i := 0; i < 1000; i++ {
+						server.Respond(flood, addr)
+					}
+				}()
+			} else {
+				server.Respond(data, addr)
+			}
+		}
+		server.Start()
+
+		// the slow client never reads
+		slowConn, err := net.Dial("tcp", "localhost:16700")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := slowConn.Write([]byte("flood")); err != nil {
+			t.Fatal(err)
+		}
+
+		cRecv := make(chan bool, 1)
+		client := NewTcpClient("localhost:16700")
+		client.Name = "TcpSourceClient"
+		client.CbData = func(data []byte) {
+			cRecv <- true
+		}
+		client.Start()
+		client.Send([]byte("R"))
+
+		select {
+		case <-cRecv:
+		case <-time.After(1 * time.Second):
+			t.Error("Timed out")
+		}
+
+		// give the proxy some time to fill the socket buffers and the write queue
+		time.Sleep(200 * time.Millisecond)
+		if err := slowConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, slowConn); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Errorf("Slow client was not disconnected: %v", err)
+			}
+		}
+
+		_ = slowConn.Close()
+		client.Stop()
+		server.Stop()
+		proxy.Stop()
+	})
+}
+
+func TestTcpProxy_timeouts(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		configure func(proxy *TcpProxy)
+		sendEvery time.Duration
+	}{
+		{"IdleTimeout", func(proxy *TcpProxy) { proxy.IdleTimeout = 100 * time.Millisecond }, 0},
+		{"IdleTimeoutWithCallbacks", func(proxy *TcpProxy) {
+			proxy.IdleTimeout = 100 * time.Millisecond
+			proxy.CbSourceData = func([]byte, net.Addr) {}
+		}, 0},
+		{"FirstByteTimeout", func(proxy *TcpProxy) { proxy.FirstByteTimeout = 100 * time.Millisecond }, 0},
+		{"MaxLifetime", func(proxy *TcpProxy) { proxy.MaxLifetime = 200 * time.Millisecond }, 20 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := NewTcpProxy(":16800", "localhost:16801")
+			test.configure(proxy)
+			proxy.Start()
+
+			server := NewTcpServer(":16801")
+			server.Name = "TcpTargetServer"
+			server.Start()
+
+			cDisconnected := make(chan bool, 1)
+			client := NewTcpClient("localhost:16800")
+			client.Name = "TcpSourceClient"
+			client.CbDisconnected = func() {
+				cDisconnected <- true
+			}
+			client.Start()
+			if test.name != "FirstByteTimeout" {
+				client.Send([]byte("R"))
+			}
+
+			var ticks <-chan time.Time
+			if test.sendEvery > 0 {
+				ticker := time.NewTicker(test.sendEvery)
+				defer ticker.Stop()
+				ticks = ticker.C
+			}
+
+			timeout := time.After(1 * time.Second)
+			for waiting := true; waiting; {
+				select {
+				case <-cDisconnected:
+					waiting = false
+				case <-ticks:
+					client.Send([]byte("R"))
+				case <-timeout:
+					t.Error("Session was not closed")
+					waiting = false
+				}
+			}
+
+			client.Stop()
+			server.Stop()
+			proxy.Stop()
+		})
+	}
+}
+
+func TestTcpProxy_connection_limits(t *testing.T) {
+
+	for _, queued := range []bool{false, true} {
+		name := "Reject"
+		if queued {
+			name = "Queue"
+		}
+		t.Run(name, func(t *testing.T) {
+			proxy := NewTcpProxy(":17000", "localhost:17001")
+			proxy.MaxConnectionsPerIP = 1
+			if queued {
+				proxy.AcceptQueueSize = 1
+				proxy.AcceptQueueTimeout = 1 * time.Second
+			}
+			proxy.Start()
+
+			server := NewTcpServer(":17001")
+			server.Name = "TcpTargetServer"
+			server.CbData = func(data []byte, addr net.Addr) {
+				server.Respond(data, addr)
+			}
+			server.Start()
+
+			cRecv := make(chan string, 2)
+			cDisconnected := make(chan string, 2)
+			var clients []*TcpClient
+			for _, clientName := range []string{"first", "second"} {
+				clientName := clientName
+				client := NewTcpClient("localhost:17000")
+				client.Name = "TcpSourceClient_" + clientName
+				client.CbData = func(data []byte) {
+					cRecv <- clientName
+				}
+				client.CbDisconnected = func() {
+					cDisconnected <- clientName
+				}
+				client.Start()
+				client.Send([]byte("R"))
+				clients = append(clients, client)
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			select {
+			case clientName := <-cRecv:
+				if clientName != "first" {
+					t.Errorf("Expected a response for the first client, but got one for the %s", clientName)
+				}
+			case <-time.After(1 * time.Second):
+				t.Error("Timed out")
+			}
+
+			if queued {
+				// the second client is served, as soon as the first one is gone
+				clients[0].Stop()
+				select {
+				case clientName := <-cRecv:
+					if clientName != "second" {
+						t.Errorf("Expected a response for the second client, but got one for the %s", clientName)
+					}
+				case <-time.After(1 * time.Second):
+					t.Error("Timed out")
+				}
+			} else {
+				select {
+				case clientName := <-cDisconnected:
+					if clientName != "second" {
+						t.Errorf("Expected the second client to be rejected, but the %s was disconnected", clientName)
+					}
+				case <-time.After(1 * time.Second):
+					t.Error("Second client was not rejected")
+				}
+			}
+
+			for _, client := range clients {
+				client.Stop()
+			}
+			server.Stop()
+			proxy.Stop()
+		})
+	}
+}
+
+// startBalancingTest starts a proxy with the strategy and target servers that respond with their port
+func startBalancingTest(t *testing.T, strategy BalancingStrategy, port int, weights ...int) (*TcpProxy, func()) {
+	var specs []string
+	var servers []*TcpServer
+	for i, weight := range weights {
+		targetPort := strconv.Itoa(port + 1 + i)
+		specs = append(specs, "localhost:"+targetPort+"*"+strconv.Itoa(weight))
+		server := NewTcpServer(":" + targetPort)
+		server.Name = "TcpTargetServer_" + targetPort
+		server.CbData = func(data []byte, addr net.Addr) {
+			server.Respond([]byte(targetPort), addr)
+		}
+		server.Start()
+		servers = append(servers, server)
+	}
+	targets, err := ParseTargets(strings.Join(specs, "|"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewBalancedTcpProxy(":"+strconv.Itoa(port), targets)
+	proxy.Balancer.Strategy = strategy
+	proxy.Start()
+	return proxy, func() {
+		proxy.Stop()
+		for _, server := range servers {
+			server.Stop()
+		}
+	}
+}
+
+// balancedConnection connects from the local IP to the proxy and returns the port of the chosen target
+func balancedConnection(t *testing.T, localIP string, port int) (net.Conn, string) {
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)}}
+	conn, err := dialer.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("R")); err != nil {
+		t.Fatal(err)
+	}
+	targetPort := make([]byte, 5)
+	if _, err := io.ReadFull(conn, targetPort); err != nil {
+		t.Fatal(err)
+	}
+	return conn, string(targetPort)
+}
+
+func TestTcpProxy_balancing(t *testing.T) {
+
+	t.Run("WeightedRoundRobin", func(t *testing.T) {
+		_, stop := startBalancingTest(t, RoundRobin, 17100, 2, 1)
+		defer stop()
+
+		received := map[string]int{}
+		for i := 0; i < 6; i++ {
+			conn, port := balancedConnection(t, "127.0.0.1", 17100)
+			received[port]++
+			_ = conn.Close()
+		}
+
+		if received["17101"] != 4 || received["17102"] != 2 {
+			t.Errorf("Expected 4 connections to the first and 2 to the second target, but got %v", received)
+		}
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		_, stop := startBalancingTest(t, Random, 17110, 2, 1)
+		defer stop()
+
+		received := map[string]int{}
+		for i := 0; i < 120; i++ {
+			conn, port := balancedConnection(t, "127.0.0.1", 17110)
+			received[port]++
+			_ = conn.Close()
+		}
+
+		// the expected distribution is 80 to 40
+		if received["17112"] == 0 || received["17111"] <= received["17112"] {
+			t.Errorf("Expected most connections to the first and some to the second target, but got %v", received)
+		}
+	})
+
+	t.Run("LeastConnections", func(t *testing.T) {
+		proxy, stop := startBalancingTest(t, LeastConnections, 17120, 1, 1)
+		defer stop()
+
+		conns := map[string][]net.Conn{}
+		for i := 0; i < 4; i++ {
+			conn, port := balancedConnection(t, "127.0.0.1", 17120)
+			defer func() { _ = conn.Close() }()
+			conns[port] = append(conns[port], conn)
+		}
+		if len(conns["17121"]) != 2 || len(conns["17122"]) != 2 {
+			t.Fatalf("Expected 2 active connections per target, but got %d and %d", len(conns["17121"]), len(conns["17122"]))
+		}
+
+		// the first target has no active connections anymore, so it gets the next ones until it has as many
+		for _, conn := range conns["17121"] {
+			_ = conn.Close()
+		}
+		first := proxy.Balancer.Targets()[0]
+		deadline := time.Now().Add(time.Second)
+		for proxy.Balancer.ActiveConnections(first) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for the connections to be released")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 0; i < 2; i++ {
+			conn, port := balancedConnection(t, "127.0.0.1", 17120)
+			defer func() { _ = conn.Close() }()
+			if port != "17121" {
+				t.Errorf("Expected connection %d to the target with the least connections, but got %v", i, port)
+			}
+		}
+	})
+
+	t.Run("SourceIPHash", func(t *testing.T) {
+		_, stop := startBalancingTest(t, SourceIPHash, 17130, 1, 1)
+		defer stop()
+
+		for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"} {
+			var first string
+			for i := 0; i < 3; i++ {
+				conn, port := balancedConnection(t, ip, 17130)
+				_ = conn.Close()
+				if first == "" {
+					first = port
+				} else if port != first {
+					t.Errorf("Expected all connections from %v to the same target, but got %v and %v", ip, first, port)
+				}
+			}
+		}
+	})
+}
+
+func TestTcpProxy_health_check(t *testing.T) {
+	targets, err := ParseTargets("localhost:17201|localhost:17202")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewBalancedTcpProxy(":17200", targets)
+	proxy.HealthChecker = NewHealthChecker("tcp", proxy.Balancer)
+	proxy.HealthChecker.Interval = 50 * time.Millisecond
+	proxy.HealthChecker.Timeout = 200 * time.Millisecond
+	proxy.HealthChecker.HealthyThreshold = 1
+	proxy.HealthChecker.UnhealthyThreshold = 1
+
+	startServer := func(port string) *TcpServer {
+		server := NewTcpServer(":" + port)
+		server.Name = "TcpTargetServer_" + port
+		server.CbData = func(data []byte, addr net.Addr) {
+			server.Respond([]byte(port), addr)
+		}
+		server.Start()
+		return server
+	}
+	awaitHealth := func(target *Target, healthy bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for proxy.HealthChecker.IsHealthy(target) != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected target %v to have health state %v", target.Address, healthy)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	server1 := startServer("17201")
+	proxy.Start()
+	awaitHealth(targets[1], false)
+
+	for i := 0; i < 4; i++ {
+		cRecv := make(chan string, 1)
+		client := NewTcpClient("localhost:17200")
+		client.Name = "TcpSourceClient_" + strconv.Itoa(i)
+		client.CbData = func(data []byte) {
+			cRecv <- string(data)
+		}
+		client.Start()
+		client.Send([]byte("R"))
+		select {
+		case port := <-cRecv:
+			if port != "17201" {
+				t.Errorf("Expected healthy target 17201, but got %v", port)
+			}
+		case <-time.After(1 * time.Second):
+			t.Error("Timed out")
+		}
+		client.Stop()
+	}
+
+	server2 := startServer("17202")
+	awaitHealth(targets[1], true)
+
+	server2.Stop()
+	server1.Stop()
+	proxy.Stop()
+}
+
+func TestTcpProxy_health_check_routes_and_tls(t *testing.T) {
+	backend := newTestCertificate(t, "backend", nil)
+	serverCert, err := tls.X509KeyPair(backend.certPEM, backend.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsServer := NewTcpServer(":17261")
+	tlsServer.Name = "TcpTargetServer_tls"
+	tlsServer.TlsConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	tlsServer.Start()
+	defer tlsServer.Stop()
+	plainServer := NewTcpServer(":17262")
+	plainServer.Name = "TcpTargetServer_plain"
+	plainServer.Start()
+	defer plainServer.Stop()
+
+	targets, err := ParseTargets("localhost:17261|localhost:17262")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewBalancedTcpProxy(":17260", targets)
+	proxy.SetName("TcpTestProxy")
+	proxy.TargetTlsConfig = &tls.Config{RootCAs: backend.pool()}
+	routed := NewBalancer([]*Target{NewTarget("localhost:17263")})
+	proxy.SniRouter = NewRouter()
+	proxy.SniRouter.Add("example.com", routed)
+	proxy.HealthChecker = NewHealthChecker("tcp", proxy.Balancer)
+	proxy.HealthChecker.Interval = 50 * time.Millisecond
+	proxy.HealthChecker.Timeout = 200 * time.Millisecond
+	proxy.HealthChecker.HealthyThreshold = 1
+	proxy.HealthChecker.UnhealthyThreshold = 1
+	proxy.Start()
+	defer proxy.Stop()
+
+	// the healthy target is checked last, after the checks of the others failed
+	expected := []struct {
+		target  *Target
+		healthy bool
+	}{
+		// a target that accepts connections, but does not speak TLS
+		{targets[1], false},
+		// the target of a route without a server
+		{routed.Targets()[0], false},
+		{targets[0], true},
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for _, e := range expected {
+		for proxy.HealthChecker.IsHealthy(e.target) != e.healthy && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if proxy.HealthChecker.IsHealthy(e.target) != e.healthy {
+			t.Errorf("Expected target %v to have health state %v", e.target.Address, e.healthy)
+		}
+	}
+}
+
+func TestTcpProxy_circuit_breaker(t *testing.T) {
+	proxy := NewTcpProxy(":17300", "localhost:17301")
+	proxy.Balancer.FailureThreshold = 2
+	proxy.Balancer.CoolDown = 300 * time.Millisecond
+	proxy.DialBackoff = 10 * time.Millisecond
+	proxy.Start()
+	target := proxy.Balancer.Targets()[0]
+
+	connect := func() (cRecv chan string, cDisconnected chan bool, client *TcpClient) {
+		cRecv = make(chan string, 1)
+		cDisconnected = make(chan bool, 1)
+		client = NewTcpClient("localhost:17300")
+		client.Name = "TcpSourceClient"
+		client.CbData = func(data []byte) {
+			cRecv <- string(data)
+		}
+		client.CbDisconnected = func() {
+			cDisconnected <- true
+		}
+		client.Start()
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		_, cDisconnected, client := connect()
+		select {
+		case <-cDisconnected:
+		case <-time.After(1 * time.Second):
+			t.Error("Source connection was not closed")
+		}
+		client.Stop()
+	}
+	if !proxy.Balancer.IsOpen(target) {
+		t.Fatal("Expected circuit breaker to be open")
+	}
+	if _, _, ok := proxy.Balancer.Acquire(&net.TCPAddr{}); ok {
+		t.Error("Expected no target to be available during cool-down")
+	}
+
+	server := NewTcpServer(":17301")
+	server.Name = "TcpTargetServer"
+	server.CbData = func(data []byte, addr net.Addr) {
+		server.Respond(data, addr)
+	}
+	server.Start()
+	time.Sleep(proxy.Balancer.CoolDown)
+
+	cRecv, _, client := connect()
+	client.Send([]byte("trial"))
+	select {
+	case data := <-cRecv:
+		if data != "trial" {
+			t.Errorf("Unexpected response: %v", data)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("Timed out")
+	}
+	client.Stop()
+	deadline := time.Now().Add(1 * time.Second)
+	for proxy.Balancer.IsOpen(target) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected circuit breaker to be closed after a successful trial")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.Stop()
+	proxy.Stop()
+}
+
+func TestTcpProxy_proxy_protocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		version ProxyProtocolVersion
+		port    int
+		parse   func(data []byte) (src, dst *net.TCPAddr, payload []byte, err error)
+	}{
+		{"V1", ProxyProtocolV1, 17400, parseProxyHeaderV1},
+		{"V2", ProxyProtocolV2, 17410, parseProxyHeaderV2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sourcePort := strconv.Itoa(test.port)
+			targetPort := strconv.Itoa(test.port + 1)
+			proxy := NewTcpProxy(":"+sourcePort, "localhost:"+targetPort)
+			proxy.ProxyProtocol = test.version
+			proxy.Start()
+
+			cRecv := make(chan []byte, 10)
+			server := NewTcpServer(":" + targetPort)
+			server.Name = "TcpTargetServer"
+			server.CbData = func(data []byte, addr net.Addr) {
+				cRecv <- append([]byte{}, data...)
+			}
+			server.Start()
+
+			client := NewTcpClient("localhost:" + sourcePort)
+			client.Name = "TcpSourceClient"
+			client.Start()
+			client.Send([]byte("payload"))
+
+			var received []byte
+			for !strings.HasSuffix(string(received), "payload") {
+				select {
+				case data := <-cRecv:
+					received = append(received, data...)
+				case <-time.After(1 * time.Second):
+					t.Fatalf("Timed out, received: %q", received)
+				}
+			}
+
+			src, dst, payload, err := test.parse(received)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientAddr := client.conn.LocalAddr().(*net.TCPAddr)
+			if !src.IP.Equal(clientAddr.IP) || src.Port != clientAddr.Port {
+				t.Errorf("Expected source %v, but got %v", clientAddr, src)
+			}
+			if dst.Port != test.port {
+				t.Errorf("Expected destination port %d, but got %v", test.port, dst)
+			}
+			if string(payload) != "payload" {
+				t.Errorf("Unexpected payload: %q", payload)
+			}
+
+			client.Stop()
+			server.Stop()
+			proxy.Stop()
+		})
+	}
+}
+
+func TestTcpProxy_accept_proxy_protocol(t *testing.T) {
+	realSource := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+	realDestination := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 80}
+	headerV2, _ := proxyHeader(ProxyProtocolV2, realSource, realDestination)
+
+	tests := []struct {
+		name          string
+		port          int
+		require       bool
+		withCallbacks bool
+		header        []byte
+		accepted      bool
+		// expectSource is the source sent to the target, nil for the remote address of the source
+		expectSource *net.TCPAddr
+	}{
+		{"V1", 17500, false, false, []byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 80\r\n"), true, realSource},
+		{"V2", 17510, true, false, headerV2, true, realSource},
+		{"V2WithCallbacks", 17520, true, true, headerV2, true, realSource},
+		{"MissingHeader", 17530, false, false, nil, true, nil},
+		{"MissingHeaderWithCallbacks", 17540, false, true, nil, true, nil},
+		{"MissingHeaderRequired", 17550, true, false, nil, false, nil},
+		{"MalformedHeader", 17560, false, false, []byte("PROXY TCP4 192.0.2.1\r\n"), false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sourcePort := strconv.Itoa(test.port)
+			targetPort := strconv.Itoa(test.port + 1)
+			proxy := NewTcpProxy(":"+sourcePort, "localhost:"+targetPort)
+			proxy.AcceptProxyProtocol = true
+			proxy.RequireProxyProtocol = test.require
+			proxy.ProxyHeaderTimeout = 200 * time.Millisecond
+			proxy.ProxyProtocol = ProxyProtocolV1
+			if test.withCallbacks {
+				proxy.CbSourceData = func([]byte, net.Addr) {}
+			}
+			proxy.Start()
+
+			cRecv := make(chan []byte, 10)
+			server := NewTcpServer(":" + targetPort)
+			server.Name = "TcpTargetServer"
+			server.CbData = func(data []byte, addr net.Addr) {
+				cRecv <- append([]byte{}, data...)
+			}
+			server.Start()
+
+			conn, err := net.Dial("tcp", "localhost:"+sourcePort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write(append(test.header, "payload"...)); err != nil {
+				t.Fatal(err)
+			}
+
+			var received []byte
+			for test.accepted && !strings.HasSuffix(string(received), "payload") {
+				select {
+				case data := <-cRecv:
+					received = append(received, data...)
+				case <-time.After(1 * time.Second):
+					t.Fatalf("Timed out, received: %q", received)
+				}
+			}
+
+			if test.accepted {
+				src, _, payload, err := parseProxyHeaderV1(received)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectSource := test.expectSource
+				if expectSource == nil {
+					expectSource = conn.LocalAddr().(*net.TCPAddr)
+				}
+				if !src.IP.Equal(expectSource.IP) || src.Port != expectSource.Port {
+					t.Errorf("Expected source %v, but got %v", expectSource, src)
+				}
+				if string(payload) != "payload" {
+					t.Errorf("Unexpected payload: %q", payload)
+				}
+			} else {
+				_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+					t.Errorf("Expected connection to be closed, but got %v", err)
+				}
+				select {
+				case data := <-cRecv:
+					t.Errorf("Unexpected data at target: %q", data)
+				default:
+				}
+			}
+
+			_ = conn.Close()
+			server.Stop()
+			proxy.Stop()
+		})
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCertificate creates a certificate for localhost, signed by the parent or self-signed as a CA
+func newTestCertificate(t testing.TB, name string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// writeFiles writes the certificate and key to PEM files in dir
+func (c *testCertificate) writeFiles(t testing.TB, dir string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func (c *testCertificate) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+func TestTcpProxy_tls_termination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_termination")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	certFile, keyFile := newTestCertificate(t, "server", ca).writeFiles(t, dir)
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.CheckInterval = 0
+
+	proxy := NewTcpProxy(":17600", "localhost:17601")
+	proxy.TlsConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	proxy.Start()
+
+	server := NewTcpServer(":17601")
+	server.Name = "TcpTargetServer"
+	server.CbData = func(data []byte, addr net.Addr) {
+		server.Respond(data, addr)
+	}
+	server.Start()
+
+	roundtrip := func(expectedName string) {
+		conn, err := tls.Dial("tcp", "localhost:17600", &tls.Config{RootCAs: ca.pool(), NextProtos: []string{"h2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if name := state.PeerCertificates[0].Subject.CommonName; name != expectedName {
+			t.Errorf("Expected certificate %v, but got %v", expectedName, name)
+		}
+		if state.NegotiatedProtocol != "h2" {
+			t.Errorf("Expected ALPN h2, but got %q", state.NegotiatedProtocol)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		response := make([]byte, 4)
+		if _, err := io.ReadFull(conn, response); err != nil || string(response) != "ping" {
+			t.Errorf("Unexpected response %q: %v", response, err)
+		}
+	}
+
+	t.Run("Roundtrip", func(t *testing.T) {
+		roundtrip("server")
+	})
+
+	t.Run("HandshakeFailure", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", "localhost:17600", &tls.Config{RootCAs: ca.pool(), MaxVersion: tls.VersionTLS11})
+		if err == nil {
+			conn.Close()
+			t.Error("Expected handshake with TLS 1.1 to fail")
+		}
+
+		plain, err := net.Dial("tcp", "localhost:17600")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer plain.Close()
+		_, _ = plain.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		_ = plain.SetReadDeadline(time.Now().Add(1 * time.Second))
+		if _, err := ioutil.ReadAll(plain); isTimeout(err) {
+			t.Error("Expected plaintext connection to be closed")
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		newTestCertificate(t, "reloaded", ca).writeFiles(t, dir)
+		modTime := time.Now().Add(time.Hour)
+		for _, file := range []string{certFile, keyFile} {
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		roundtrip("reloaded")
+	})
+
+	server.Stop()
+	proxy.Stop()
+}
+
+func TestTcpProxy_tls_origination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_origination")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	otherCa := newTestCertificate(t, "other-ca", nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := newTestCertificate(t, "client", ca).writeFiles(t, dir)
+	backend := newTestCertificate(t, "backend", ca)
+	serverCert, err := tls.X509KeyPair(backend.certPEM, backend.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		port       int
+		caFile     string
+		serverName string
+		insecure   bool
+		clientAuth bool
+		succeeds   bool
+	}{
+		{"TrustedCa", 17700, caFile, "", false, false, true},
+		{"UntrustedCa", 17710, "", "", false, false, false},
+		{"InsecureSkipVerify", 17720, "", "", true, false, true},
+		{"ServerName", 17730, caFile, "backend", false, false, true},
+		{"WrongServerName", 17740, caFile, "wrong", false, false, false},
+		{"ClientCertificate", 17750, caFile, "", false, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sourcePort := strconv.Itoa(test.port)
+			targetPort := strconv.Itoa(test.port + 1)
+			proxy := NewTcpProxy(":"+sourcePort, "localhost:"+targetPort)
+			certFile, keyFile := certFile, keyFile
+			if !test.clientAuth {
+				certFile, keyFile = "", ""
+			}
+			proxy.TargetTlsConfig, err = NewClientTlsConfig(test.caFile, certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.caFile == "" {
+				// never trust the system CAs in tests
+				proxy.TargetTlsConfig.RootCAs = otherCa.pool()
+			}
+			proxy.TargetTlsConfig.ServerName = test.serverName
+			proxy.TargetTlsConfig.InsecureSkipVerify = test.insecure
+			proxy.Start()
+
+			server := NewTcpServer(":" + targetPort)
+			server.Name = "TcpTargetServer"
+			server.TlsConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+			if test.clientAuth {
+				server.TlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				server.TlsConfig.ClientCAs = ca.pool()
+			}
+			server.CbData = func(data []byte, addr net.Addr) {
+				server.Respond(data, addr)
+			}
+			server.Start()
+
+			conn, err := net.Dial("tcp", "localhost:"+sourcePort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			response := make([]byte, 4)
+			_, err = io.ReadFull(conn, response)
+			if test.succeeds && (err != nil || string(response) != "ping") {
+				t.Errorf("Unexpected response %q: %v", response, err)
+			}
+			if !test.succeeds && (err == nil || isTimeout(err)) {
+				t.Errorf("Expected source connection to be closed, but got %q: %v", response, err)
+			}
+
+			server.Stop()
+			proxy.Stop()
+		})
+	}
+}
+
+func TestTcpProxy_mutual_tls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mutual_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	otherCa := newTestCertificate(t, "other-ca", nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestCertificate(t, "server", ca)
+	serverCert, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewTcpProxy(":17800", "localhost:17801")
+	proxy.TlsConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	if err := RequireClientCertificates(proxy.TlsConfig, caFile); err != nil {
+		t.Fatal(err)
+	}
+	proxy.CertificateRouter = NewRouter()
+	proxy.CertificateRouter.Add("team-a", NewBalancer([]*Target{NewTarget("localhost:17801")}))
+	proxy.CertificateRouter.Add("*.team-b.example", NewBalancer([]*Target{NewTarget("localhost:17802")}))
+	proxy.Start()
+
+	var targets []*TcpServer
+	for _, port := range []string{"17801", "17802"} {
+		port := port
+		target := NewTcpServer(":" + port)
+		target.Name = "TcpTargetServer_" + port
+		target.CbData = func(data []byte, addr net.Addr) {
+			target.Respond([]byte(port), addr)
+		}
+		target.Start()
+		targets = append(targets, target)
+	}
+
+	tests := []struct {
+		name       string
+		clientCert *testCertificate
+		expected   string
+	}{
+		{"TeamA", newTestCertificate(t, "team-a", ca), "17801"},
+		{"TeamBWildcard", newTestCertificate(t, "app.team-b.example", ca), "17802"},
+		{"NoRoute", newTestCertificate(t, "team-c", ca), ""},
+		{"UntrustedCa", newTestCertificate(t, "team-a", otherCa), ""},
+		{"NoCertificate", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: ca.pool()}
+			if test.clientCert != nil {
+				clientCert, err := tls.X509KeyPair(test.clientCert.certPEM, test.clientCert.keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				config.Certificates = []tls.Certificate{clientCert}
+			}
+			conn, err := tls.Dial("tcp", "localhost:17800", config)
+			if err != nil {
+				if test.expected != "" {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write([]byte("ping"))
+			_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			response := make([]byte, 5)
+			_, err = io.ReadFull(conn, response)
+			if test.expected != "" && (err != nil || string(response) != test.expected) {
+				t.Errorf("Expected response from %v, but got %q: %v", test.expected, response, err)
+			}
+			if test.expected == "" && (err == nil || isTimeout(err)) {
+				t.Errorf("Expected connection to be closed, but got %q: %v", response, err)
+			}
+		})
+	}
+
+	for _, target := range targets {
+		target.Stop()
+	}
+	proxy.Stop()
+}
+
+func TestTcpProxy_sni_routing(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+
+	for _, withCallbacks := range []bool{false, true} {
+		name := "Relay"
+		port := 17900
+		if withCallbacks {
+			name = "WithCallbacks"
+			port = 17910
+		}
+		t.Run(name, func(t *testing.T) {
+			sourceAddress := "localhost:" + strconv.Itoa(port)
+			targetAddress := func(i int) string {
+				return "localhost:" + strconv.Itoa(port+i)
+			}
+			proxy := NewTcpProxy(":"+strconv.Itoa(port), targetAddress(3))
+			proxy.SniRouter = NewRouter()
+			proxy.SniRouter.Add("a.example", NewBalancer([]*Target{NewTarget(targetAddress(1))}))
+			proxy.SniRouter.Add("*.b.example", NewBalancer([]*Target{NewTarget(targetAddress(2))}))
+			proxy.SniRouter.Default = proxy.Balancer
+			if withCallbacks {
+				proxy.CbSourceData = func([]byte, net.Addr) {}
+			}
+			proxy.Start()
+
+			var targets []*TcpServer
+			for i, serverName := range []string{"a.example", "x.b.example", "default.example"} {
+				certificate := newTestCertificate(t, serverName, ca)
+				cert, err := tls.X509KeyPair(certificate.certPEM, certificate.keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				serverName := serverName
+				target := NewTcpServer(targetAddress(i + 1))
+				target.Name = "TcpTargetServer_" + serverName
+				target.TlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+				target.CbData = func(data []byte, addr net.Addr) {
+					target.Respond([]byte(serverName), addr)
+				}
+				target.Start()
+				targets = append(targets, target)
+			}
+
+			// the default target has a certificate for a different name, so it is not verified
+			tests := []struct {
+				serverName string
+				expected   string
+				insecure   bool
+			}{
+				{"a.example", "a.example", false},
+				{"x.b.example", "x.b.example", false},
+				{"other.example", "default.example", true},
+				// no SNI is sent for IP addresses
+				{"", "default.example", true},
+			}
+			for _, test := range tests {
+				config := &tls.Config{RootCAs: ca.pool(), ServerName: test.serverName, InsecureSkipVerify: test.insecure}
+				address := sourceAddress
+				if test.serverName == "" {
+					address = "127.0.0.1:" + strconv.Itoa(port)
+				}
+				conn, err := tls.Dial("tcp", address, config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = conn.Write([]byte("ping"))
+				_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+				response := make([]byte, len(test.expected))
+				if _, err := io.ReadFull(conn, response); err != nil || string(response) != test.expected {
+					t.Errorf("Expected response from %v for %q, but got %q: %v", test.expected, test.serverName, response, err)
+				}
+				conn.Close()
+			}
+
+			plain, err := net.Dial("tcp", sourceAddress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = plain.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+			_ = plain.SetReadDeadline(time.Now().Add(1 * time.Second))
+			if _, err := ioutil.ReadAll(plain); isTimeout(err) {
+				t.Error("Expected plaintext connection to be closed")
+			}
+			plain.Close()
+
+			for _, target := range targets {
+				target.Stop()
+			}
+			proxy.Stop()
+		})
+	}
+}
+
+func TestTcpProxy_protocol_sniffing(t *testing.T) {
+	names := []string{"fallback", ProtocolTls, ProtocolHttp, ProtocolHttp2, ProtocolSsh, "redis", "magic"}
+	targetAddress := func(i int) string {
+		return "localhost:" + strconv.Itoa(18001+i)
+	}
+
+	proxy := NewTcpProxy(":18000", targetAddress(0))
+	proxy.Sniffer = NewSniffer()
+	proxy.Sniffer.Timeout = 100 * time.Millisecond
+	proxy.Sniffer.AddRegexp("redis", regexp.MustCompile(`^\*[0-9]+\r\n`))
+	proxy.Sniffer.AddPrefix("magic", []byte("MAGIC"))
+	proxy.ProtocolRouter = NewRouter()
+	proxy.ProtocolRouter.Default = proxy.Balancer
+	for i, name := range names[1:] {
+		proxy.ProtocolRouter.Add(name, NewBalancer([]*Target{NewTarget(targetAddress(i + 1))}))
+	}
+	proxy.Start()
+
+	var targets []*TcpServer
+	for i, name := range names {
+		name := name
+		target := NewTcpServer(targetAddress(i))
+		target.Name = "TcpTargetServer_" + name
+		target.CbConnected = func(addr net.Addr) {
+			target.Respond([]byte(name+"|"), addr)
+		}
+		target.CbData = func(data []byte, addr net.Addr) {
+			target.Respond(data, addr)
+		}
+		target.Start()
+		targets = append(targets, target)
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"Tls", "\x16\x03\x01\x00\x05hello", ProtocolTls},
+		{"Http", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", ProtocolHttp},
+		{"Http2", string(http2Preface), ProtocolHttp2},
+		{"Ssh", "SSH-2.0-OpenSSH_9.0\r\n", ProtocolSsh},
+		{"Regexp", "*1\r\n$4\r\nPING\r\n", "redis"},
+		{"Prefix", "MAGIC123", "magic"},
+		{"Unknown", "hello world", "fallback"},
+		{"ServerFirst", "", "fallback"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", "localhost:18000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if test.data != "" {
+				if _, err := conn.Write([]byte(test.data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected := test.expected + "|" + test.data
+			_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			response := make([]byte, len(expected))
+			if _, err := io.ReadFull(conn, response); err != nil || string(response) != expected {
+				t.Errorf("Expected %q, but got %q: %v", expected, response, err)
+			}
+		})
+	}
+
+	for _, target := range targets {
+		target.Stop()
+	}
+	proxy.Stop()
+}
+
+func TestTcpProxy_unix_sockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix_sockets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	proxySocket := filepath.Join(dir, "proxy.sock")
+
+	// a socket file of a process that did not stop cleanly
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: proxySocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	// Unix socket -> TCP -> abstract Unix socket
+	server := NewTcpServer("unix:@tcp_proxy_unix_sockets_test")
+	server.Name = "TcpTargetServer"
+	server.CbData = func(data []byte, addr net.Addr) {
+		server.Respond(data, addr)
+	}
+	server.Start()
+	defer server.Stop()
+
+	reverseProxy := NewTcpProxy("localhost:19100", "unix:@tcp_proxy_unix_sockets_test")
+	reverseProxy.SetName("TcpToUnixProxy")
+	reverseProxy.Start()
+	defer reverseProxy.Stop()
+
+	proxy := NewTcpProxy("unix:"+proxySocket, "localhost:19100")
+	proxy.SetName("UnixToTcpProxy")
+	proxy.MaxConnectionsPerIP = 2
+	proxy.Start()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", proxySocket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		req := "Request " + strconv.Itoa(i)
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		res := make([]byte, len(req))
+		if _, err := io.ReadFull(conn, res); err != nil {
+			t.Fatalf("Could not receive response %d: %v", i, err)
+		}
+		if string(res) != req {
+			t.Errorf("Expected %v, but got %s", req, res)
+		}
+	}
+
+	// all clients of a Unix socket count as one IP
+	conn, err := net.Dial("unix", proxySocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("Expected the third connection to be rejected, but got %v", err)
+	}
+	_ = conn.Close()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+
+	proxy.Stop()
+	if _, err := os.Stat(proxySocket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket file to be removed on stop, but got %v", err)
+	}
+}
+
+func TestTcpProxy_ipv6(t *testing.T) {
+	tests := []struct {
+		name          string
+		sourceAddress string
+		targetAddress string
+	}{
+		{"IPv6ToIPv6", "[::1]:19200", "[::1]:19201"},
+		{"IPv4ToIPv6", "127.0.0.1:19300", "[::1]:19301"},
+		{"IPv6ToIPv4", "[::1]:19400", "127.0.0.1:19401"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewTcpServer(test.targetAddress)
+			server.Name = "TcpTargetServer"
+			server.CbData = func(data []byte, addr net.Addr) {
+				server.Respond(data, addr)
+			}
+			server.Start()
+			defer server.Stop()
+
+			proxy := NewTcpProxy(test.sourceAddress, test.targetAddress)
+			proxy.Start()
+			defer proxy.Stop()
+
+			conn, err := net.Dial("tcp", test.sourceAddress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+			_ = conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write([]byte(test.name)); err != nil {
+				t.Fatal(err)
+			}
+			res := make([]byte, len(test.name))
+			if _, err := io.ReadFull(conn, res); err != nil {
+				t.Fatal(err)
+			}
+			if string(res) != test.name {
+				t.Errorf("Expected %v, but got %s", test.name, res)
+			}
+		})
+	}
+}
+
+func TestTcpProxy_shutdown(t *testing.T) {
+	server := NewTcpServer("127.0.0.1:19601")
+	server.Name = "TcpTargetServer"
+	server.CbData = func(data []byte, addr net.Addr) {
+		server.Respond(data, addr)
+	}
+	server.Start()
+	defer server.Stop()
+
+	proxy := NewTcpProxy("127.0.0.1:19600", "127.0.0.1:19601")
+	proxy.Start()
+
+	echo := func(conn net.Conn, message string) error {
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(message)); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, len(message)))
+		return err
+	}
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:19600")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		if err := echo(conn, "Hello"); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	type result struct{ drained, killed int }
+	done := make(chan result)
+	go func() {
+		drained, killed := proxy.Shutdown(ctx)
+		done <- result{drained, killed}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if conn, err := net.Dial("tcp", "127.0.0.1:19600"); err == nil {
+		_ = conn.Close()
+		t.Error("Expected new connections to be refused while shutting down")
+	}
+	// existing sessions keep working until they finish
+	for _, conn := range conns {
+		if err := echo(conn, "Still there"); err != nil {
+			t.Fatalf("Expected the session to keep working while shutting down, but got %v", err)
+		}
+	}
+	_ = conns[0].Close()
+
+	select {
+	case r := <-done:
+		if r.drained != 1 || r.killed != 1 {
+			t.Errorf("Expected 1 drained and 1 killed session, but got %d and %d", r.drained, r.killed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the shutdown")
+	}
+	_ = conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conns[1].Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("Expected the remaining session to be closed, but got %v", err)
+	}
+}
+
+// recordWriter passes every line of an access log to a channel
+type recordWriter chan []byte
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	w <- append([]byte{}, p...)
+	return len(p), nil
+}
+
+// nextSessionRecord waits for the next line of the access log and decodes it
+func nextSessionRecord(t *testing.T, w recordWriter) (record SessionRecord) {
+	t.Helper()
+	select {
+	case line := <-w:
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("Could not decode access log line %q: %v", line, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a session record")
+	}
+	return
+}
+
+func TestTcpProxy_access_log(t *testing.T) {
+	tests := []struct {
+		name          string
+		withCallbacks bool
+		port          int
+	}{
+		{"Relay", false, 19800},
+		{"Callbacks", true, 19810},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sourceAddress := "127.0.0.1:" + strconv.Itoa(test.port)
+			targetAddress := "127.0.0.1:" + strconv.Itoa(test.port+1)
+			server := NewTcpServer(targetAddress)
+			server.Name = "TcpTargetServer"
+			server.CbData = func(data []byte, addr net.Addr) {
+				server.Respond(data, addr)
+			}
+			server.Start()
+			defer server.Stop()
+
+			records := make(recordWriter, 2)
+			proxy := NewTcpProxy(sourceAddress, targetAddress)
+			proxy.SetName("TcpTestProxy")
+			proxy.AccessLog = NewAccessLog(records)
+			if test.withCallbacks {
+				proxy.CbSourceData = func([]byte, net.Addr) {}
+			}
+			proxy.Start()
+			defer proxy.Stop()
+
+			echo := func(conn net.Conn, message string) {
+				_ = conn.SetDeadline(time.Now().Add(time.Second))
+				if _, err := conn.Write([]byte(message)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, make([]byte, len(message))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var conns []*net.TCPConn
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("tcp", sourceAddress)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = conn.Close() }()
+				conns = append(conns, conn.(*net.TCPConn))
+			}
+			echo(conns[0], "Hello")
+			echo(conns[1], "Hi")
+
+			// the first session is closed by the source
+			if err := conns[0].CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, conns[0]); err != nil {
+				t.Fatal(err)
+			}
+			record := nextSessionRecord(t, records)
+			if record.ID == "" || record.Proxy != "TcpTestProxy" || record.Network != "tcp" {
+				t.Errorf("Unexpected identification of the session: %+v", record)
+			}
+			if record.Source != conns[0].LocalAddr().String() || record.SourceLocal != sourceAddress ||
+				record.Target != targetAddress || record.TargetLocal == "" {
+				t.Errorf("Unexpected addresses of the session: %+v", record)
+			}
+			if record.Start.IsZero() || record.End.Before(record.Start) {
+				t.Errorf("Unexpected start %v and end %v", record.Start, record.End)
+			}
+			if record.BytesFromSource != 5 || record.BytesFromTarget != 5 {
+				t.Errorf("Expected 5 bytes in each direction, but got %d and %d", record.BytesFromSource, record.BytesFromTarget)
+			}
+			if record.CloseReason != "source closed" || record.ClosedBy != ClosedBySource {
+				t.Errorf("Expected the session to be closed by the source, but got %q by %v", record.CloseReason, record.ClosedBy)
+			}
+
+			// the second session is closed by the proxy
+			proxy.Stop()
+			record = nextSessionRecord(t, records)
+			if record.Source != conns[1].LocalAddr().String() {
+				t.Errorf("Expected a record for %v, but got %v", conns[1].LocalAddr(), record.Source)
+			}
+			if record.BytesFromSource != 2 || record.BytesFromTarget != 2 {
+				t.Errorf("Expected 2 bytes in each direction, but got %d and %d", record.BytesFromSource, record.BytesFromTarget)
+			}
+			if record.CloseReason != "proxy stopped" || record.ClosedBy != ClosedByProxy {
+				t.Errorf("Expected the session to be closed by the proxy, but got %q by %v", record.CloseReason, record.ClosedBy)
+			}
+		})
+	}
+}
+
+func TestTcpProxy_listen_failure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:19900")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	// the port is in use, so the proxy can not listen, but has to shut down cleanly
+	proxy := NewTcpProxy("127.0.0.1:19900", "127.0.0.1:19901")
+	proxy.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if drained, killed := proxy.Shutdown(ctx); drained != 0 || killed != 0 {
+		t.Errorf("Expected no sessions, but got %d drained and %d killed", drained, killed)
+	}
+	proxy.Stop()
+}
+
+func TestTcpProxy_stopped_while_dialing(t *testing.T) {
+	tests := []struct {
+		name          string
+		withCallbacks bool
+		port          int
+	}{
+		{"Relay", false, 19920},
+		{"Callbacks", true, 19930},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// nothing listens on the target, so the proxy keeps retrying until the first-byte timeout
+			sourceAddress := "127.0.0.1:" + strconv.Itoa(test.port)
+			proxy := NewTcpProxy(sourceAddress, "127.0.0.1:"+strconv.Itoa(test.port+1))
+			proxy.DialRetries = 100
+			proxy.DialBackoff = 20 * time.Millisecond
+			proxy.DialMaxBackoff = 20 * time.Millisecond
+			proxy.FirstByteTimeout = 100 * time.Millisecond
+			if test.withCallbacks {
+				proxy.CbSourceData = func([]byte, net.Addr) {}
+			}
+			proxy.Start()
+			defer proxy.Stop()
+
+			conn, err := net.Dial("tcp", sourceAddress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+				t.Fatalf("Expected the session to be closed, but got %v", err)
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for {
+				proxy.mutex.Lock()
+				clients := len(proxy.clients)
+				proxy.mutex.Unlock()
+				if clients == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected no clients after the session was closed, but got %d", clients)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestTcpProxy_accept_proxy_protocol_server_first(t *testing.T) {
+	for i, withCallbacks := range []bool{false, true} {
+		sourcePort := strconv.Itoa(17570 + 10*i)
+		targetPort := strconv.Itoa(17571 + 10*i)
+		proxy := NewTcpProxy(":"+sourcePort, "localhost:"+targetPort)
+		proxy.AcceptProxyProtocol = true
+		proxy.ProxyHeaderTimeout = 200 * time.Millisecond
+		if withCallbacks {
+			proxy.CbSourceData = func([]byte, net.Addr) {}
+		}
+		proxy.Start()
+
+		// the target speaks first, like an SMTP server, so the source does not send a header or any data
+		server := NewTcpServer(":" + targetPort)
+		server.Name = "TcpTargetServer"
+		server.CbConnected = func(addr net.Addr) {
+			server.Respond([]byte("220 ready\r\n"), addr)
+		}
+		server.Start()
+
+		conn, err := net.Dial("tcp", "localhost:"+sourcePort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		greeting := make([]byte, len("220 ready\r\n"))
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			t.Errorf("Expected the greeting of the target after the header timeout, but got %v", err)
+		} else if string(greeting) != "220 ready\r\n" {
+			t.Errorf("Unexpected greeting: %q", greeting)
+		}
+
+		_ = conn.Close()
+		server.Stop()
+		proxy.Stop()
+	}
+}
@@ -1,22 +1,134 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 type TcpServer struct {
 	Name           string
 	CbData         func(data []byte, addr net.Addr)
 	CbConnected    func(addr net.Addr)
+	CbReadClosed   func(addr net.Addr)
 	CbDisconnected func(addr net.Addr)
-	address        string
-	listener       *net.TCPListener
-	connections    map[string]*net.TCPConn
-	running        bool
-	mutex          sync.Mutex
-	handlers       sync.WaitGroup
+	CbRejected     func(addr net.Addr, reason string)
+	// Handler takes over accepted connections, if set. The connection is closed when the handler returns.
+	// CbData and CbReadClosed are not called for these connections.
+	// The addr identifies the connection and prefix contains data that was already read from the connection.
+	Handler func(conn StreamConn, addr net.Addr, prefix []byte)
+	// HalfClose keeps a connection open for writing after the remote side closed its write direction,
+	// until CloseWrite is called for it
+	HalfClose bool
+	// WriteQueueSize is the maximum number of pending responses per connection
+	WriteQueueSize int
+	// WriteQueuePolicy defines what happens if the write queue of a connection is full
+	WriteQueuePolicy OverflowPolicy
+	// MaxConnections limits the number of concurrent connections, if greater than zero
+	MaxConnections int
+	// MaxConnectionsPerIP limits the number of concurrent connections per remote IP, if greater than zero.
+	// All connections to a Unix socket count as one IP.
+	MaxConnectionsPerIP int
+	// AcceptQueueSize is the number of connections that may wait for a free slot, if a limit is reached.
+	// Further connections are rejected immediately.
+	AcceptQueueSize int
+	// AcceptQueueTimeout is the maximum time a connection waits for a free slot. Zero means no timeout.
+	AcceptQueueTimeout time.Duration
+	// AcceptProxyProtocol reads a PROXY protocol v1 or v2 header from new connections and identifies them by
+	// the contained source address instead of their remote address. The header is not authenticated, so every
+	// client that can connect can claim any source address for MaxConnectionsPerIP, routing and logs.
+	// It should only be enabled if all clients are trusted proxies, or together with RequireProxyProtocol
+	// behind a firewall that only admits them.
+	AcceptProxyProtocol bool
+	// RequireProxyProtocol rejects connections without a valid PROXY protocol header. Otherwise, connections
+	// without a header keep their remote address, but they have to send data first or wait for ProxyHeaderTimeout.
+	RequireProxyProtocol bool
+	// ProxyHeaderTimeout is the maximum time to wait for the PROXY protocol header
+	ProxyHeaderTimeout time.Duration
+	// TlsConfig terminates TLS on accepted connections, if set
+	TlsConfig *tls.Config
+	// TlsHandshakeTimeout is the maximum time for the TLS handshake
+	TlsHandshakeTimeout time.Duration
+	// Sniffer classifies new connections by their first bytes, if set. The protocol is provided with Protocol
+	// and the read bytes are passed on as the first data of the connection.
+	Sniffer *Sniffer
+	// ReadClientHello reads the TLS ClientHello of new connections without terminating TLS, to provide the
+	// requested server name with ServerName. The ClientHello is passed on as the first data of the connection.
+	// Connections that do not start with a ClientHello are rejected. It is ignored, if TlsConfig is set.
+	ReadClientHello bool
+	// SocketOptions tune the listening socket and the accepted connections, if set
+	SocketOptions    *SocketOptions
+	address          string
+	listener         net.Listener
+	connections      map[string]*tcpServerConn
+	connectionsPerIP map[string]int
+	// handshakes are connections that are reading the PROXY protocol header
+	handshakes map[StreamConn]bool
+	// unixConnections counts the accepted connections of a Unix socket to identify them
+	unixConnections int
+	queued          int
+	slotFreed       chan struct{}
+	running         bool
+	// draining rejects new connections, while the existing ones are finishing
+	draining bool
+	mutex    sync.Mutex
+	handlers sync.WaitGroup
+}
+
+// tcpServerConn is a single accepted connection of a TcpServer
+type tcpServerConn struct {
+	// conn is either the accepted connection or the TLS connection on top of it
+	conn StreamConn
+	// rawConn is the accepted TCP or Unix connection
+	rawConn StreamConn
+	// addr identifies the connection. It is the source address from the PROXY protocol header, if any.
+	addr net.Addr
+	// localAddr is the address the source connected to
+	localAddr net.Addr
+	// prefix is data that was read while looking for a PROXY protocol header
+	prefix []byte
+	// tlsState is set after a TLS handshake
+	tlsState *tls.ConnectionState
+	// serverName is the server name from the ClientHello, with ReadClientHello
+	serverName string
+	// protocol is the protocol detected by the Sniffer
+	protocol        string
+	queue           chan []byte
+	writeClosed     chan struct{}
+	writeClosedOnce sync.Once
+	closed          chan struct{}
+	closedOnce      sync.Once
+}
+
+// newTcpServerConn creates a connection that is identified by the given addr
+func newTcpServerConn(conn StreamConn, addr net.Addr, queueSize int) *tcpServerConn {
+	return &tcpServerConn{
+		conn:        conn,
+		rawConn:     conn,
+		addr:        addr,
+		localAddr:   conn.LocalAddr(),
+		queue:       make(chan []byte, queueSize),
+		writeClosed: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// markWriteClosed releases a receiver that waits for the write direction to be closed
+func (c *tcpServerConn) markWriteClosed() {
+	c.writeClosedOnce.Do(func() { close(c.writeClosed) })
+}
+
+// markClosed stops the writer and releases everyone waiting for the connection
+func (c *tcpServerConn) markClosed() {
+	c.closedOnce.Do(func() { close(c.closed) })
+	c.markWriteClosed()
 }
 
 func NewTcpServer(address string) (t *TcpServer) {
@@ -24,9 +136,18 @@ func NewTcpServer(address string) (t *TcpServer) {
 	t.Name = "TcpServer"
 	t.CbData = func([]byte, net.Addr) {}
 	t.CbConnected = func(net.Addr) {}
+	t.CbReadClosed = func(net.Addr) {}
 	t.CbDisconnected = func(net.Addr) {}
+	t.CbRejected = func(net.Addr, string) {}
 	t.address = address
-	t.connections = map[string]*net.TCPConn{}
+	t.connections = map[string]*tcpServerConn{}
+	t.connectionsPerIP = map[string]int{}
+	t.handshakes = map[StreamConn]bool{}
+	t.slotFreed = make(chan struct{})
+	t.WriteQueueSize = 64
+	t.WriteQueuePolicy = OverflowBlock
+	t.ProxyHeaderTimeout = 5 * time.Second
+	t.TlsHandshakeTimeout = 10 * time.Second
 	return
 }
 
@@ -37,20 +158,18 @@ func (s *TcpServer) Start() {
 	if s.running {
 		return
 	}
-	s.running = true
-
-	addr, err := net.ResolveTCPAddr("tcp", s.address)
-	if err != nil {
-		log.Printf("%v - Could resolve address %v: %v", s.Name, s.address, err)
-		return
-	}
 
-	s.listener, err = net.ListenTCP("tcp", addr)
+	listener, err := listenStream(s.address, s.SocketOptions)
 	if err != nil {
+		// the server stays stopped, so that Stop and Drain have no listener to close
 		log.Printf("%v - Could not listen at %v: %v", s.Name, s.address, err)
 		return
 	}
+	s.listener = listener
+	s.running = true
+	s.draining = false
 
+	s.handlers.Add(1)
 	go s.accept()
 }
 
@@ -63,15 +182,76 @@ func (s *TcpServer) Stop() {
 	}
 	s.running = false
 
-	if err := s.listener.Close(); err != nil {
+	// the listener is already closed after draining
+	if err := s.listener.Close(); err != nil && !isClosedConnError(err) {
 		log.Printf("%v - Could not close client connection: %v", s.Name, err)
 	}
+	for _, serverConn := range s.connections {
+		// close the TCP connection directly, to not wait for a TLS close notification
+		if err := serverConn.rawConn.Close(); err != nil && !isClosedConnError(err) {
+			log.Printf("%v - Could not close connection: %v", s.Name, err)
+		}
+		serverConn.markClosed()
+	}
+	for conn := range s.handshakes {
+		if err := conn.Close(); err != nil && !isClosedConnError(err) {
+			log.Printf("%v - Could not close connection: %v", s.Name, err)
+		}
+	}
+	// release queued connections
+	s.notifySlotFreed()
 
+	// handlers need the mutex to clean up their connections
+	s.mutex.Unlock()
 	s.handlers.Wait()
-	s.connections = map[string]*net.TCPConn{}
+	s.mutex.Lock()
+
+	s.connections = map[string]*tcpServerConn{}
+	s.connectionsPerIP = map[string]int{}
 	s.listener = nil
 }
 
+// Drain stops accepting new connections and waits until the existing connections are closed or the context is done.
+// It returns the number of connections that were closed and that are still open. Stop closes the remaining ones.
+func (s *TcpServer) Drain(ctx context.Context) (closed, remaining int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running || s.draining {
+		return 0, len(s.connections)
+	}
+	s.draining = true
+
+	if err := s.listener.Close(); err != nil {
+		log.Printf("%v - Could not close listener: %v", s.Name, err)
+	}
+	// connections that are not established yet are rejected
+	for conn := range s.handshakes {
+		if err := conn.Close(); err != nil && !isClosedConnError(err) {
+			log.Printf("%v - Could not close connection: %v", s.Name, err)
+		}
+	}
+	s.notifySlotFreed()
+
+	total := len(s.connections)
+	log.Printf("%v - Draining %d connections", s.Name, total)
+	for len(s.connections) > 0 {
+		// slotFreed is notified for every closed connection
+		slotFreed := s.slotFreed
+		s.mutex.Unlock()
+		select {
+		case <-slotFreed:
+		case <-ctx.Done():
+		}
+		s.mutex.Lock()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	remaining = len(s.connections)
+	return total - remaining, remaining
+}
+
 func (s *TcpServer) isRunning() bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -79,63 +259,532 @@ func (s *TcpServer) isRunning() bool {
 }
 
 func (s *TcpServer) accept() {
-	log.Printf("%v - Listening on %s", s.Name, s.listener.Addr())
-
-	s.handlers.Add(1)
 	defer s.handlers.Done()
+	log.Printf("%v - Listening on %s", s.Name, s.listener.Addr())
 
 	for {
-		conn, err := s.listener.AcceptTCP()
+		accepted, err := s.listener.Accept()
 		if err != nil {
 			log.Printf("%v - Could not accept new connection: %v", s.Name, err)
 			break
 		}
-		s.mutex.Lock()
-		s.connections[conn.RemoteAddr().String()] = conn
-		s.mutex.Unlock()
-		s.CbConnected(conn.RemoteAddr())
-		log.Printf("%v - Start receiving: %s -> %s", s.Name, conn.RemoteAddr(), conn.LocalAddr())
-		go s.receive(conn)
+		conn := accepted.(StreamConn)
+		if s.AcceptProxyProtocol || s.Sniffer != nil || s.TlsConfig != nil || s.ReadClientHello {
+			s.startHandshake(conn)
+		} else {
+			s.admitAndServe(newTcpServerConn(conn, s.connectionAddr(conn), s.WriteQueueSize))
+		}
 	}
 
 	log.Printf("%v - Stop listening on %s", s.Name, s.listener.Addr())
 }
 
-func (s *TcpServer) receive(conn *net.TCPConn) {
+// connectionAddr returns the address that identifies a new connection. Clients of Unix sockets
+// usually have no address, so they are numbered.
+func (s *TcpServer) connectionAddr(conn StreamConn) net.Addr {
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); !ok {
+		return conn.RemoteAddr()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unixConnections++
+	return &net.UnixAddr{Net: "unix", Name: fmt.Sprintf("%v#%d", conn.LocalAddr(), s.unixConnections)}
+}
+
+// startHandshake reads the PROXY protocol header and performs the TLS handshake of a new connection
+// in a separate goroutine
+func (s *TcpServer) startHandshake(conn StreamConn) {
+	addr := s.connectionAddr(conn)
+	s.mutex.Lock()
+	if !s.running || s.draining {
+		s.mutex.Unlock()
+		s.reject(newTcpServerConn(conn, addr, 0), "server stopped")
+		return
+	}
+	s.handshakes[conn] = true
 	s.handlers.Add(1)
+	s.mutex.Unlock()
+	go s.handshake(conn, addr)
+}
+
+func (s *TcpServer) handshake(conn StreamConn, addr net.Addr) {
+	defer s.handlers.Done()
+
+	serverConn := newTcpServerConn(conn, addr, s.WriteQueueSize)
+	var err error
+	if s.AcceptProxyProtocol {
+		err = s.readProxyHeader(serverConn)
+	}
+	if err == nil && s.Sniffer != nil {
+		err = s.sniff(serverConn)
+	}
+	if err == nil && s.TlsConfig != nil {
+		err = s.tlsHandshake(serverConn)
+	} else if err == nil && s.ReadClientHello {
+		err = s.readClientHello(serverConn)
+	}
+	s.mutex.Lock()
+	delete(s.handshakes, conn)
+	s.mutex.Unlock()
+	if err != nil {
+		s.reject(serverConn, err.Error())
+		return
+	}
+	s.admitAndServe(serverConn)
+}
+
+// readProxyHeader replaces the addresses of the connection with the ones from the PROXY protocol header
+func (s *TcpServer) readProxyHeader(serverConn *tcpServerConn) error {
+	conn := serverConn.conn
+	if s.ProxyHeaderTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.ProxyHeaderTimeout)); err != nil {
+			return err
+		}
+	}
+	source, destination, prefix, err := readProxyHeader(conn)
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if err != nil {
+		if s.RequireProxyProtocol || !errors.Is(err, errNoProxyHeader) {
+			return fmt.Errorf("invalid PROXY protocol header: %w", err)
+		}
+		serverConn.prefix = prefix
+		return nil
+	}
+	if source != nil {
+		log.Printf("%v - Connection from %v is proxied for %v", s.Name, conn.RemoteAddr(), source)
+		serverConn.addr = source
+		serverConn.localAddr = destination
+	}
+	return nil
+}
+
+// tlsHandshake wraps the connection with TLS
+func (s *TcpServer) tlsHandshake(serverConn *tcpServerConn) error {
+	conn := serverConn.rawConn
+	if len(serverConn.prefix) > 0 {
+		// the prefix is the start of the TLS handshake
+		conn = &prefixConn{StreamConn: conn, prefix: serverConn.prefix}
+		serverConn.prefix = nil
+	}
+	tlsConn := tls.Server(conn, s.TlsConfig)
+	if s.TlsHandshakeTimeout > 0 {
+		if err := tlsConn.SetDeadline(time.Now().Add(s.TlsHandshakeTimeout)); err != nil {
+			return err
+		}
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		log.Printf("%v - TLS handshake with %v completed: %v, ALPN %q, client certificate %v", s.Name, serverConn.addr,
+			tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol, certificateIdentities(state.PeerCertificates[0]))
+	} else {
+		log.Printf("%v - TLS handshake with %v completed: %v, ALPN %q", s.Name, serverConn.addr,
+			tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol)
+	}
+	serverConn.conn = tlsConn
+	serverConn.tlsState = &state
+	return nil
+}
+
+// sniff detects the protocol of the connection and keeps the read data as prefix
+func (s *TcpServer) sniff(serverConn *tcpServerConn) error {
+	conn := serverConn.rawConn
+	if len(serverConn.prefix) > 0 {
+		conn = &prefixConn{StreamConn: conn, prefix: serverConn.prefix}
+	}
+	protocol, data, err := s.Sniffer.Sniff(conn)
+	if err != nil {
+		return fmt.Errorf("could not detect protocol: %w", err)
+	}
+	if protocol == "" {
+		log.Printf("%v - Unknown protocol from %v", s.Name, serverConn.addr)
+	} else {
+		log.Printf("%v - Detected protocol %v from %v", s.Name, protocol, serverConn.addr)
+	}
+	serverConn.prefix = data
+	serverConn.protocol = protocol
+	return nil
+}
+
+// readClientHello reads the server name from the TLS ClientHello and keeps the read data as prefix
+func (s *TcpServer) readClientHello(serverConn *tcpServerConn) error {
+	conn := serverConn.rawConn
+	if s.TlsHandshakeTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.TlsHandshakeTimeout)); err != nil {
+			return err
+		}
+	}
+	var r io.Reader = conn
+	if len(serverConn.prefix) > 0 {
+		r = io.MultiReader(bytes.NewReader(serverConn.prefix), conn)
+	}
+	serverName, hello, err := readClientHello(r)
+	if err != nil {
+		return fmt.Errorf("could not read TLS ClientHello: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	log.Printf("%v - TLS ClientHello from %v for server name %q", s.Name, serverConn.addr, serverName)
+	serverConn.prefix = hello
+	serverConn.serverName = serverName
+	return nil
+}
+
+// admitAndServe serves the connection, if it is admitted. Otherwise, it is either queued or rejected.
+func (s *TcpServer) admitAndServe(serverConn *tcpServerConn) {
+	if admitted, reason := s.admit(serverConn); admitted {
+		s.serve(serverConn)
+	} else if reason != "" {
+		s.reject(serverConn, reason)
+	}
+}
+
+// admit registers the connection, if the connection limits allow it. Otherwise, the connection is either
+// queued until a slot is free, or the reason for rejecting it is returned.
+func (s *TcpServer) admit(serverConn *tcpServerConn) (bool, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.draining {
+		return false, "server stopped"
+	}
+	if s.isRegistered(serverConn.addr) {
+		return false, "duplicate source address"
+	}
+	if s.hasFreeSlot(serverConn) {
+		s.register(serverConn)
+		return true, ""
+	}
+	if s.queued < s.AcceptQueueSize {
+		s.queued++
+		s.handlers.Add(1)
+		go s.await(serverConn)
+		return false, ""
+	}
+	return false, "connection limit reached"
+}
+
+// await waits for a free slot for a queued connection
+func (s *TcpServer) await(serverConn *tcpServerConn) {
+	defer s.handlers.Done()
+
+	var timeout <-chan time.Time
+	if s.AcceptQueueTimeout > 0 {
+		timer := time.NewTimer(s.AcceptQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	s.mutex.Lock()
+	for s.running && !s.draining && !s.hasFreeSlot(serverConn) {
+		slotFreed := s.slotFreed
+		s.mutex.Unlock()
+		select {
+		case <-slotFreed:
+		case <-timeout:
+			s.mutex.Lock()
+			s.queued--
+			s.mutex.Unlock()
+			s.reject(serverConn, "timed out in accept queue")
+			return
+		}
+		s.mutex.Lock()
+	}
+	s.queued--
+	if !s.running || s.draining {
+		s.mutex.Unlock()
+		s.reject(serverConn, "server stopped")
+		return
+	}
+	if s.isRegistered(serverConn.addr) {
+		s.mutex.Unlock()
+		s.reject(serverConn, "duplicate source address")
+		return
+	}
+	s.register(serverConn)
+	s.mutex.Unlock()
+	s.serve(serverConn)
+}
+
+// hasFreeSlot checks the connection limits for a new connection. The mutex must be locked.
+func (s *TcpServer) hasFreeSlot(serverConn *tcpServerConn) bool {
+	if s.MaxConnections > 0 && len(s.connections) >= s.MaxConnections {
+		return false
+	}
+	if s.MaxConnectionsPerIP > 0 && s.connectionsPerIP[remoteIP(serverConn.addr)] >= s.MaxConnectionsPerIP {
+		return false
+	}
+	return true
+}
+
+// isRegistered checks, if there is a connection for the addr. The mutex must be locked.
+func (s *TcpServer) isRegistered(addr net.Addr) bool {
+	_, ok := s.connections[addr.String()]
+	return ok
+}
+
+// register adds a new connection. The mutex must be locked.
+func (s *TcpServer) register(serverConn *tcpServerConn) {
+	s.connections[serverConn.addr.String()] = serverConn
+	s.connectionsPerIP[remoteIP(serverConn.addr)]++
+}
+
+// notifySlotFreed wakes up all queued connections. The mutex must be locked.
+func (s *TcpServer) notifySlotFreed() {
+	close(s.slotFreed)
+	s.slotFreed = make(chan struct{})
+}
+
+func (s *TcpServer) reject(serverConn *tcpServerConn, reason string) {
+	log.Printf("%v - Rejected connection from %v: %v", s.Name, serverConn.addr, reason)
+	s.CbRejected(serverConn.addr, reason)
+	if err := serverConn.conn.Close(); err != nil && !isClosedConnError(err) {
+		log.Printf("%v - Could not close connection: %v", s.Name, err)
+	}
+}
+
+// serve starts handling a registered connection
+func (s *TcpServer) serve(serverConn *tcpServerConn) {
+	s.CbConnected(serverConn.addr)
+	if s.Handler != nil {
+		s.handlers.Add(1)
+		go s.handle(serverConn)
+	} else {
+		log.Printf("%v - Start receiving: %s -> %s", s.Name, serverConn.addr, serverConn.localAddr)
+		s.handlers.Add(2)
+		go s.receive(serverConn)
+		go s.write(serverConn)
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return "unix"
+	}
+	return addr.String()
+}
+
+func (s *TcpServer) handle(serverConn *tcpServerConn) {
+	defer s.handlers.Done()
+	s.Handler(serverConn.conn, serverConn.addr, serverConn.prefix)
+	s.disconnect(serverConn)
+}
+
+func (s *TcpServer) receive(serverConn *tcpServerConn) {
 	defer s.handlers.Done()
 
+	conn := serverConn.conn
+	addr := serverConn.addr
+	if len(serverConn.prefix) > 0 {
+		s.CbData(serverConn.prefix, addr)
+	}
 	firstData := true
 	data := make([]byte, maxDatagramSize)
 	for {
 		n, err := conn.Read(data)
 		if err != nil {
-			log.Printf("%v - Could not receive data: %v -> %s: %s", s.Name, conn.RemoteAddr(), conn.LocalAddr(), err)
+			if s.HalfClose && errors.Is(err, io.EOF) {
+				log.Printf("%v - Remote closed write direction: %v -> %s", s.Name, addr, serverConn.localAddr)
+				s.CbReadClosed(addr)
+				<-serverConn.writeClosed
+				break
+			}
+			log.Printf("%v - Could not receive data: %v -> %s: %s", s.Name, addr, serverConn.localAddr, err)
 			break
 		}
 		if firstData {
 			firstData = false
-			log.Printf("%v - Received data: %v -> %v", s.Name, conn.RemoteAddr(), conn.LocalAddr())
+			log.Printf("%v - Received data: %v -> %v", s.Name, addr, serverConn.localAddr)
 		}
-		s.CbData(data[:n], conn.RemoteAddr())
+		s.CbData(data[:n], addr)
 	}
 
+	s.disconnect(serverConn)
+	log.Printf("%v - Stop receiving: %v -> %v", s.Name, addr, serverConn.localAddr)
+}
+
+func (s *TcpServer) disconnect(serverConn *tcpServerConn) {
+	conn := serverConn.conn
 	s.mutex.Lock()
-	delete(s.connections, conn.RemoteAddr().String())
+	if s.connections[serverConn.addr.String()] == serverConn {
+		delete(s.connections, serverConn.addr.String())
+		ip := remoteIP(serverConn.addr)
+		if s.connectionsPerIP[ip]--; s.connectionsPerIP[ip] <= 0 {
+			delete(s.connectionsPerIP, ip)
+		}
+		s.notifySlotFreed()
+	}
 	s.mutex.Unlock()
-	s.CbDisconnected(conn.RemoteAddr())
-	log.Printf("%v - Stop receiving: %v -> %v", s.Name, conn.RemoteAddr(), conn.LocalAddr())
+	serverConn.markClosed()
+	if err := conn.Close(); err != nil && !isClosedConnError(err) {
+		log.Printf("%v - Could not close connection: %v", s.Name, err)
+	}
+	s.CbDisconnected(serverConn.addr)
 }
 
-func (s *TcpServer) Respond(data []byte, addr net.Addr) {
+// write sends the queued responses to the connection, until it is closed.
+// A nil entry closes the write direction.
+func (s *TcpServer) write(serverConn *tcpServerConn) {
+	defer s.handlers.Done()
+
+	conn := serverConn.conn
+	for {
+		select {
+		case <-serverConn.closed:
+			return
+		case data := <-serverConn.queue:
+			if data == nil {
+				if err := conn.CloseWrite(); err != nil && !isClosedConnError(err) {
+					log.Printf("%v - Could not close write direction of %v: %v", s.Name, serverConn.addr, err)
+				}
+				serverConn.markWriteClosed()
+				if !s.HalfClose {
+					if err := conn.Close(); err != nil && !isClosedConnError(err) {
+						log.Printf("%v - Could not close connection: %v", s.Name, err)
+					}
+				}
+				continue
+			}
+			if _, err := conn.Write(data); err != nil {
+				if !isClosedConnError(err) {
+					log.Printf("%v - Could not respond: %v -> %v: %s", s.Name, serverConn.localAddr, serverConn.addr, err)
+				}
+				if err := conn.Close(); err != nil && !isClosedConnError(err) {
+					log.Printf("%v - Could not close connection: %v", s.Name, err)
+				}
+				serverConn.markClosed()
+				return
+			}
+		}
+	}
+}
+
+// ActiveConnections returns the number of registered connections
+func (s *TcpServer) ActiveConnections() int {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	return len(s.connections)
+}
+
+// Respond queues the data for the connection to the given addr.
+// If the queue is full, the WriteQueuePolicy is applied.
+func (s *TcpServer) Respond(data []byte, addr net.Addr) {
+	if serverConn, ok := s.getConnection(addr); ok {
+		// the data slice may be reused by the caller
+		s.enqueue(serverConn, append([]byte{}, data...))
+	}
+}
+
+// LocalAddr returns the local address of the connection from addr, or nil if it is unknown
+func (s *TcpServer) LocalAddr(addr net.Addr) net.Addr {
+	if serverConn, ok := s.getConnection(addr); ok {
+		return serverConn.localAddr
+	}
+	return nil
+}
+
+// ConnectionState returns the TLS state of the connection from addr, or nil without TLS
+func (s *TcpServer) ConnectionState(addr net.Addr) *tls.ConnectionState {
+	if serverConn, ok := s.getConnection(addr); ok {
+		return serverConn.tlsState
+	}
+	return nil
+}
+
+// Protocol returns the protocol of the connection from addr that was detected by the Sniffer, or an empty string
+func (s *TcpServer) Protocol(addr net.Addr) string {
+	if serverConn, ok := s.getConnection(addr); ok {
+		return serverConn.protocol
+	}
+	return ""
+}
 
+// ServerName returns the server name that the connection from addr requested with TLS SNI
+func (s *TcpServer) ServerName(addr net.Addr) string {
+	if serverConn, ok := s.getConnection(addr); ok {
+		if serverConn.tlsState != nil {
+			return serverConn.tlsState.ServerName
+		}
+		return serverConn.serverName
+	}
+	return ""
+}
+
+func (s *TcpServer) getConnection(addr net.Addr) (serverConn *tcpServerConn, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if s.running {
-		if conn, ok := s.connections[addr.String()]; ok {
-			if _, err := conn.Write(data); err != nil {
-				log.Printf("%v - Could not respond: %v -> %v: %s", s.Name, s.listener.Addr(), addr, err)
-			}
+		serverConn, ok = s.connections[addr.String()]
+	}
+	return
+}
+
+func (s *TcpServer) enqueue(serverConn *tcpServerConn, data []byte) {
+	if s.WriteQueuePolicy == OverflowBlock || data == nil {
+		select {
+		case serverConn.queue <- data:
+		case <-serverConn.closed:
+		}
+		return
+	}
+
+	select {
+	case serverConn.queue <- data:
+		return
+	case <-serverConn.closed:
+		return
+	default:
+	}
+
+	switch s.WriteQueuePolicy {
+	case OverflowDrop:
+		log.Printf("%v - Write queue of %v is full, dropping %d bytes", s.Name, serverConn.addr, len(data))
+	case OverflowDisconnect:
+		log.Printf("%v - Write queue of %v is full, closing connection", s.Name, serverConn.addr)
+		if err := serverConn.rawConn.Close(); err != nil && !isClosedConnError(err) {
+			log.Printf("%v - Could not close connection: %v", s.Name, err)
 		}
+		serverConn.markClosed()
+	}
+}
+
+// CloseWrite closes the write direction of the connection to the given addr, after all queued responses were sent.
+// With HalfClose, the connection is closed completely as soon as the remote side closed its write direction as well.
+// Without HalfClose, the connection is closed right away.
+func (s *TcpServer) CloseWrite(addr net.Addr) {
+	if serverConn, ok := s.getConnection(addr); ok {
+		s.enqueue(serverConn, nil)
+	}
+}
+
+// Close the connection to the given addr. With reset, the connection is aborted with a RST instead of a FIN.
+func (s *TcpServer) Close(addr net.Addr, reset bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	serverConn, ok := s.connections[addr.String()]
+	if !ok {
+		return
+	}
+	if tcpConn, ok := serverConn.rawConn.(*net.TCPConn); ok && reset {
+		if err := tcpConn.SetLinger(0); err != nil {
+			log.Printf("%v - Could not set linger: %v", s.Name, err)
+		}
+	}
+	// close the TCP connection directly, as a TLS close notification could block while holding the mutex
+	if err := serverConn.rawConn.Close(); err != nil {
+		log.Printf("%v - Could not close connection to %v: %v", s.Name, addr, err)
 	}
+	serverConn.markClosed()
 }
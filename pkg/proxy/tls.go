@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTlsVersion parses one of: 1.0, 1.1, 1.2, 1.3
+func ParseTlsVersion(version string) (uint16, error) {
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version: %v", version)
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func ParseCipherSuites(names string) (ids []uint16, err error) {
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(names, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %v", name)
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// NewServerTlsConfig creates a TLS config with TLS 1.2 as minimum version and a certificate that is reloaded,
+// when the certificate or key file changes
+func NewServerTlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// RequireClientCertificates only accepts clients with a certificate signed by one of the CAs in caFile
+func RequireClientCertificates(config *tls.Config, caFile string) error {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// NewClientTlsConfig creates a TLS config for connecting to targets with TLS 1.2 as minimum version.
+// The caFile replaces the system CAs, if set. The client certificate is optional and reloaded on changes.
+func NewClientTlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		reloader, err := NewCertificateReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return config, nil
+}
+
+// loadCertPool reads all certificates from a PEM file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %v", file)
+	}
+	return pool, nil
+}
+
+// CertificateReloader provides a certificate from disk and reloads it, when one of the files was modified
+type CertificateReloader struct {
+	Name string
+	// CheckInterval is the minimum time between two checks for modified files
+	CheckInterval time.Duration
+	certFile      string
+	keyFile       string
+	cert          *tls.Certificate
+	modTime       time.Time
+	lastCheck     time.Time
+	mutex         sync.Mutex
+}
+
+// NewCertificateReloader loads the certificate and key from the given PEM files
+func NewCertificateReloader(certFile, keyFile string) (r *CertificateReloader, err error) {
+	r = new(CertificateReloader)
+	r.Name = "CertificateReloader"
+	r.CheckInterval = time.Second
+	r.certFile = certFile
+	r.keyFile = keyFile
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload loads the certificate and key from disk. On failure, the previous certificate is kept.
+func (r *CertificateReloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate and can be used as tls.Config.GetCertificate
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	check := time.Since(r.lastCheck) >= r.CheckInterval
+	if check {
+		r.lastCheck = time.Now()
+	}
+	lastModTime := r.modTime
+	r.mutex.Unlock()
+
+	if check {
+		if modTime, err := r.latestModTime(); err != nil {
+			log.Printf("%v - Could not check %v: %v", r.Name, r.certFile, err)
+		} else if !modTime.Equal(lastModTime) {
+			if err := r.Reload(); err != nil {
+				log.Printf("%v - Could not reload %v: %v", r.Name, r.certFile, err)
+			} else {
+				log.Printf("%v - Reloaded %v", r.Name, r.certFile)
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cert, nil
+}
+
+// GetClientCertificate returns the current certificate and can be used as tls.Config.GetClientCertificate
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.GetCertificate(nil)
+}
+
+// latestModTime returns the latest modification time of the certificate and key file
+func (r *CertificateReloader) latestModTime() (latest time.Time, err error) {
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return
+}
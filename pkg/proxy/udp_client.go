@@ -9,15 +9,17 @@ import (
 
 // UdpClient establishes a UDP connection to a server
 type UdpClient struct {
-	Name         string
-	Consumer     func([]byte)
-	address      string
-	conns        []*net.UDPConn
-	running      bool
-	mutex        sync.Mutex
-	receivers    sync.WaitGroup
-	Verbose      bool
-	statsPrinter *StatsPrinter
+	Name      string
+	Consumer  func([]byte)
+	address   string
+	conns     []*net.UDPConn
+	running   bool
+	mutex     sync.Mutex
+	receivers sync.WaitGroup
+	Verbose   bool
+	// SocketOptions tune the sockets, if set
+	SocketOptions *SocketOptions
+	statsPrinter  *StatsPrinter
 }
 
 // NewUdpClient creates a new UDP client
@@ -60,6 +62,16 @@ func (c *UdpClient) Stop() {
 	}
 }
 
+// LocalAddrs returns the addresses the client sends from, one per connection
+func (c *UdpClient) LocalAddrs() (addrs []net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, conn := range c.conns {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+	return
+}
+
 // Send data to the server
 func (c *UdpClient) Send(data []byte) {
 	c.mutex.Lock()
@@ -83,35 +95,61 @@ func (c *UdpClient) connect() {
 		return
 	}
 
-	iaddrs, err := net.InterfaceAddrs()
+	ifis, err := net.Interfaces()
 	if err != nil {
-		log.Printf("%v - Could not retrieve interface addresses: %v", c.Name, err)
+		log.Printf("%v - Could not retrieve interfaces: %v", c.Name, err)
 		return
 	}
 
-	for _, iaddr := range iaddrs {
-		if !addr.IP.IsMulticast() && !iaddr.(*net.IPNet).Contains(addr.IP) {
-			continue
+	for _, ifi := range ifis {
+		for _, laddr := range localAddrs(ifi, addr) {
+			conn, err := c.SocketOptions.dialUdp(laddr, addr)
+			if err != nil {
+				log.Printf("%v - Could not connect to %v at %v: %v", c.Name, addr, laddr, err)
+				continue
+			}
+
+			c.conns = append(c.conns, conn)
+			go c.receive(conn)
 		}
-		ip := iaddr.(*net.IPNet).IP
-		if ip.To4() == nil {
-			// Ignore IPv6 for now
+	}
+}
+
+// localAddrs returns the addresses of the interface to send from to the given address.
+// These are the addresses of the same IP family in the network of a unicast address.
+// IPv4 multicast is sent from all IPv4 addresses. IPv6 multicast is sent from the link-local address
+// of each multicast interface, which binds the connection to the interface.
+func localAddrs(ifi net.Interface, addr *net.UDPAddr) (laddrs []*net.UDPAddr) {
+	if addr.Zone != "" && addr.Zone != ifi.Name {
+		return
+	}
+	iaddrs, err := ifi.Addrs()
+	if err != nil {
+		return
+	}
+	ipv6 := addr.IP.To4() == nil
+	for _, iaddr := range iaddrs {
+		ipNet, ok := iaddr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() == nil) != ipv6 {
 			continue
 		}
-		laddr := &net.UDPAddr{IP: ip}
-		conn, err := net.DialUDP("udp", laddr, addr)
-		if err != nil {
-			log.Printf("%v - Could not connect to %v at %v: %v", c.Name, addr, laddr, err)
-			continue
+		switch {
+		case !addr.IP.IsMulticast():
+			if !ipNet.Contains(addr.IP) {
+				continue
+			}
+		case ipv6:
+			if ifi.Flags&net.FlagMulticast == 0 || !ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
 		}
-
-		if err := conn.SetWriteBuffer(maxDatagramSize); err != nil {
-			log.Printf("%v - Could not set read buffer: %v", c.Name, err)
+		laddr := &net.UDPAddr{IP: ipNet.IP}
+		if ipNet.IP.IsLinkLocalUnicast() {
+			laddr.Zone = ifi.Name
 		}
-
-		c.conns = append(c.conns, conn)
-		go c.receive(conn)
+		laddrs = append(laddrs, laddr)
 	}
+	return
 }
 
 func (c *UdpClient) receive(conn *net.UDPConn) {
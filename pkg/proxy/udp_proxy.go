@@ -1,44 +1,102 @@
 package proxy
 
 import (
+	"context"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type udpProxyClient struct {
-	address *net.UDPAddr
-	client  *UdpClient
-	parent  *UdpProxy
-	Verbose bool
+	// lastActivity and the counters are accessed atomically and must be 64-bit aligned
+	lastActivity      int64
+	bytesFromSource   int64
+	bytesFromTarget   int64
+	packetsFromSource int64
+	packetsFromTarget int64
+	record            *SessionRecord
+	address           *net.UDPAddr
+	target            *Target
+	trial             bool
+	client            *UdpClient
+	parent            *UdpProxy
+	Verbose           bool
 }
 
 func (c *udpProxyClient) newData(data []byte) {
 	if c.Verbose {
 		log.Printf("Got %d bytes for %s", len(data), c.address)
 	}
+	c.touch(&c.bytesFromTarget, &c.packetsFromTarget, len(data))
 	c.parent.server.Respond(data, c.address)
 }
 func (c *udpProxyClient) send(data []byte) {
+	c.touch(&c.bytesFromSource, &c.packetsFromSource, len(data))
 	c.client.Send(data)
 }
 
+// touch counts a datagram of n bytes
+func (c *udpProxyClient) touch(bytes, packets *int64, n int) {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	atomic.AddInt64(bytes, int64(n))
+	atomic.AddInt64(packets, 1)
+}
+
+// idleSince returns the time of the last datagram in any direction
+func (c *udpProxyClient) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
 func (c *udpProxyClient) Start() {
 	c.client.Start()
+	var addrs []string
+	for _, addr := range c.client.LocalAddrs() {
+		addrs = append(addrs, addr.String())
+	}
+	c.record.TargetLocal = strings.Join(addrs, ",")
 }
 
-func (c *udpProxyClient) Stop() {
+// Stop the client and write the record of the session with the reason to the access log
+func (c *udpProxyClient) Stop(reason string) {
 	c.client.Stop()
+	c.record.End = time.Now()
+	c.record.BytesFromSource = atomic.LoadInt64(&c.bytesFromSource)
+	c.record.BytesFromTarget = atomic.LoadInt64(&c.bytesFromTarget)
+	c.record.PacketsFromSource = atomic.LoadInt64(&c.packetsFromSource)
+	c.record.PacketsFromTarget = atomic.LoadInt64(&c.packetsFromTarget)
+	c.record.CloseReason = reason
+	c.record.ClosedBy = ClosedByProxy
+	c.parent.AccessLog.Log(c.record)
 }
 
 // UdpProxy is a proxy for UDP
 type UdpProxy struct {
 	name          string
 	sourceAddress string
-	targetAddress string
-	server        *UdpServer
-	clients       map[string]*udpProxyClient
-	Verbose       bool
-	statsPrinter  *StatsPrinter
+	// Balancer chooses the target for each new source address
+	Balancer *Balancer
+	// HealthChecker excludes unhealthy targets, if set
+	HealthChecker *HealthChecker
+	// SourceSocketOptions tune the sockets of the sources, if set
+	SourceSocketOptions *SocketOptions
+	// TargetSocketOptions tune the sockets to the targets, if set
+	TargetSocketOptions *SocketOptions
+	// IdleTimeout ends the session of a source address, if no datagram was relayed in any direction
+	// for this duration. It is checked with a granularity of a quarter of the timeout.
+	// Without it, sessions are kept until the proxy is stopped.
+	IdleTimeout time.Duration
+	// AccessLog records every expired or stopped session, if set
+	AccessLog    *AccessLog
+	server       *UdpServer
+	clients      map[string]*udpProxyClient
+	mutex        sync.Mutex
+	running      bool
+	done         chan struct{}
+	Verbose      bool
+	statsPrinter *StatsPrinter
 	Proxy
 }
 
@@ -46,9 +104,16 @@ type UdpProxy struct {
 // sourceAddress: The address to listen on
 // targetAddress: The address to redirect data to
 func NewUdpProxy(sourceAddress, targetAddress string) (p *UdpProxy) {
+	return NewBalancedUdpProxy(sourceAddress, []*Target{NewTarget(targetAddress)})
+}
+
+// NewBalancedUdpProxy creates a new UDP Proxy with:
+// sourceAddress: The address to listen on
+// targets: The targets to distribute the source addresses to
+func NewBalancedUdpProxy(sourceAddress string, targets []*Target) (p *UdpProxy) {
 	p = new(UdpProxy)
 	p.sourceAddress = sourceAddress
-	p.targetAddress = targetAddress
+	p.Balancer = NewBalancer(targets)
 	p.server = NewUdpServer(sourceAddress)
 	p.server.Consumer = p.newDataFromSource
 	p.clients = map[string]*udpProxyClient{}
@@ -68,16 +133,52 @@ func (p *UdpProxy) SetVerbose(verbose bool) {
 
 // Start the proxy
 func (p *UdpProxy) Start() {
+	if p.HealthChecker != nil {
+		p.HealthChecker.Start()
+	}
+	p.server.SocketOptions = p.SourceSocketOptions
+	p.mutex.Lock()
+	p.running = true
+	if p.IdleTimeout > 0 && p.done == nil {
+		p.done = make(chan struct{})
+		go p.expire(p.done)
+	}
+	p.mutex.Unlock()
 	p.server.Start()
 }
 
 // Stop the proxy
 func (p *UdpProxy) Stop() {
+	p.mutex.Lock()
+	p.running = false
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	p.mutex.Unlock()
 	p.server.Stop()
-	for _, c := range p.clients {
-		c.Stop()
+	if p.HealthChecker != nil {
+		p.HealthChecker.Stop()
 	}
+	p.mutex.Lock()
+	clients := p.clients
 	p.clients = map[string]*udpProxyClient{}
+	p.mutex.Unlock()
+	for _, c := range clients {
+		c.Stop("proxy stopped")
+		p.Balancer.Release(c.target, c.trial)
+	}
+}
+
+// Shutdown stops the proxy right away, because the end of a UDP session is unknown.
+// All sessions are counted as killed.
+func (p *UdpProxy) Shutdown(context.Context) (drained, killed int) {
+	p.mutex.Lock()
+	killed = len(p.clients)
+	p.mutex.Unlock()
+	p.Stop()
+	log.Printf("%v - Shut down with %d drained and %d killed sessions", p.name, drained, killed)
+	return
 }
 
 func (p *UdpProxy) newDataFromSource(data []byte, sourceAddr *net.UDPAddr) {
@@ -85,16 +186,81 @@ func (p *UdpProxy) newDataFromSource(data []byte, sourceAddr *net.UDPAddr) {
 		log.Printf("Got %d bytes from %s", len(data), sourceAddr.String())
 	}
 	p.statsPrinter.NewMessage(p.name + ":from_source")
+	client, ok := p.getClient(sourceAddr)
+	if ok {
+		client.send(data)
+	}
+}
+
+// getClient returns the client of the source address and creates it, if it does not exist yet
+// It is called by the receiver of the server, so it must not wait for the server.
+func (p *UdpProxy) getClient(sourceAddr *net.UDPAddr) (*udpProxyClient, bool) {
+	p.mutex.Lock()
 	client, ok := p.clients[sourceAddr.String()]
+	p.mutex.Unlock()
+	if ok {
+		return client, true
+	}
+
+	target, trial, ok := p.Balancer.Acquire(sourceAddr)
 	if !ok {
-		client = &udpProxyClient{address: sourceAddr, parent: p}
-		client.Verbose = p.Verbose
-		client.client = NewUdpClient(p.targetAddress)
-		client.client.Name = p.name + "_Client_" + sourceAddr.String()
-		client.client.Consumer = client.newData
-		client.client.Verbose = p.Verbose
-		p.clients[sourceAddr.String()] = client
-		client.Start()
+		log.Printf("%v - No target available for %v", p.name, sourceAddr)
+		return nil, false
+	}
+	client = &udpProxyClient{address: sourceAddr, target: target, trial: trial, parent: p}
+	client.Verbose = p.Verbose
+	client.record = newSessionRecord(p.name, "udp")
+	client.record.Source = sourceAddr.String()
+	if addr := p.server.LocalAddr(); addr != nil {
+		client.record.SourceLocal = addr.String()
+	}
+	client.record.Target = target.Address
+	client.lastActivity = client.record.Start.UnixNano()
+	client.client = NewUdpClient(target.Address)
+	client.client.Name = p.name + "_Client_" + sourceAddr.String()
+	client.client.Consumer = client.newData
+	client.client.Verbose = p.Verbose
+	client.client.SocketOptions = p.TargetSocketOptions
+	// the client is started without the lock, so that Stop and the expiry are not blocked meanwhile.
+	// It still runs on the receiver of the server, so other sources wait, while the target is resolved.
+	client.Start()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.running {
+		// the server waits for this receiver while stopping, so the client must not wait for the server
+		go client.client.Stop()
+		p.Balancer.Release(target, trial)
+		return nil, false
+	}
+	p.clients[sourceAddr.String()] = client
+	return client, true
+}
+
+// expire ends the sessions that were idle for longer than the IdleTimeout, until done is closed
+func (p *UdpProxy) expire(done chan struct{}) {
+	ticker := time.NewTicker(p.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			var expired []*udpProxyClient
+			p.mutex.Lock()
+			for key, c := range p.clients {
+				if now.Sub(c.idleSince()) >= p.IdleTimeout {
+					delete(p.clients, key)
+					expired = append(expired, c)
+				}
+			}
+			p.mutex.Unlock()
+			for _, c := range expired {
+				reason := "idle timeout of " + p.IdleTimeout.String() + " expired"
+				log.Printf("%v - Closing %v -> %v: %v", p.name, c.address, c.target.Address, reason)
+				c.Stop(reason)
+				p.Balancer.Release(c.target, c.trial)
+			}
+		}
 	}
-	client.send(data)
 }
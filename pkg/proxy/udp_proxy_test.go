@@ -4,6 +4,7 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -108,3 +109,204 @@ func TestUdpProxy_multi_client(t *testing.T) {
 		server.Stop()
 	})
 }
+
+func TestUdpProxy_ipv6(t *testing.T) {
+	tests := []struct {
+		name          string
+		sourceAddress string
+		targetAddress string
+	}{
+		{"IPv6ToIPv6", "[::1]:15200", "[::1]:15201"},
+		{"IPv4ToIPv6", "127.0.0.1:15300", "[::1]:15301"},
+		{"IPv6ToIPv4", "[::1]:15400", "127.0.0.1:15401"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := NewUdpProxy(test.sourceAddress, test.targetAddress)
+			proxy.SetName("UdpTestProxy")
+			proxy.Start()
+			defer proxy.Stop()
+
+			server := NewUdpServer(test.targetAddress)
+			server.Consumer = func(data []byte, addr *net.UDPAddr) {
+				server.Respond(data, addr)
+			}
+			server.Name = "UdpTestServer"
+			server.Start()
+			defer server.Stop()
+
+			cRecv := make(chan string, 1)
+			client := NewUdpClient(test.sourceAddress)
+			client.Consumer = func(data []byte) {
+				cRecv <- string(data)
+			}
+			client.Name = "UdpTestClient"
+			client.Start()
+			defer client.Stop()
+
+			client.Send([]byte(test.name))
+
+			select {
+			case res := <-cRecv:
+				if res != test.name {
+					t.Errorf("Expected to receive %s, but got %s", test.name, res)
+				}
+			case <-time.After(1 * time.Second):
+				t.Error("Timed out")
+			}
+		})
+	}
+}
+
+func TestUdpProxy_access_log(t *testing.T) {
+	records := make(recordWriter, 2)
+	proxy := NewUdpProxy("127.0.0.1:15700", "127.0.0.1:15701")
+	proxy.SetName("UdpTestProxy")
+	proxy.IdleTimeout = 200 * time.Millisecond
+	proxy.AccessLog = NewAccessLog(records)
+	proxy.Start()
+	defer proxy.Stop()
+
+	server := NewUdpServer("127.0.0.1:15701")
+	server.Consumer = func(data []byte, addr *net.UDPAddr) {
+		server.Respond([]byte("Response"), addr)
+	}
+	server.Name = "UdpTestServer"
+	server.Start()
+	defer server.Stop()
+
+	conn, err := net.Dial("udp", "127.0.0.1:15700")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	roundtrip := func() {
+		if _, err := conn.Write([]byte("Request")); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, maxDatagramSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roundtrip()
+	roundtrip()
+
+	// the session expires without datagrams
+	record := nextSessionRecord(t, records)
+	if record.ID == "" || record.Proxy != "UdpTestProxy" || record.Network != "udp" {
+		t.Errorf("Unexpected identification of the session: %+v", record)
+	}
+	if record.Source != conn.LocalAddr().String() || record.SourceLocal != "127.0.0.1:15700" ||
+		record.Target != "127.0.0.1:15701" || record.TargetLocal == "" {
+		t.Errorf("Unexpected addresses of the session: %+v", record)
+	}
+	if record.End.Sub(record.Start) < proxy.IdleTimeout {
+		t.Errorf("Expected the session to last at least %v, but got %v", proxy.IdleTimeout, record.End.Sub(record.Start))
+	}
+	if record.PacketsFromSource != 2 || record.PacketsFromTarget != 2 || record.BytesFromSource != 14 || record.BytesFromTarget != 16 {
+		t.Errorf("Unexpected counters of the session: %+v", record)
+	}
+	if !strings.HasPrefix(record.CloseReason, "idle timeout") || record.ClosedBy != ClosedByProxy {
+		t.Errorf("Expected the session to expire, but got %q by %v", record.CloseReason, record.ClosedBy)
+	}
+
+	// a new session starts with the next datagram and is closed by the proxy
+	roundtrip()
+	proxy.Stop()
+	record = nextSessionRecord(t, records)
+	if record.PacketsFromSource != 1 || record.PacketsFromTarget != 1 {
+		t.Errorf("Expected 1 datagram in each direction, but got %d and %d", record.PacketsFromSource, record.PacketsFromTarget)
+	}
+	if record.CloseReason != "proxy stopped" || record.ClosedBy != ClosedByProxy {
+		t.Errorf("Expected the session to be closed by the proxy, but got %q by %v", record.CloseReason, record.ClosedBy)
+	}
+}
+
+func TestUdpProxy_stop_with_new_sources(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		proxy := NewUdpProxy("127.0.0.1:15800", "127.0.0.1:15801")
+		proxy.SetName("UdpTestProxy")
+		proxy.Start()
+
+		// datagrams of new sources arrive while the proxy stops
+		done := make(chan struct{})
+		sent := make(chan struct{})
+		go func() {
+			defer close(sent)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				conn, err := net.Dial("udp", "127.0.0.1:15800")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, _ = conn.Write([]byte("Request"))
+				_ = conn.Close()
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			proxy.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out stopping the proxy")
+		}
+		close(done)
+		<-sent
+	}
+}
+
+func TestUdpProxy_health_check(t *testing.T) {
+	responses := map[string]string{"15901": "PONG 15901", "15902": "ERROR"}
+	for port, response := range responses {
+		server := NewUdpServer("127.0.0.1:" + port)
+		server.Name = "UdpTargetServer_" + port
+		response := response
+		server.Consumer = func(data []byte, addr *net.UDPAddr) {
+			if string(data) == "PING" {
+				server.Respond([]byte(response), addr)
+			}
+		}
+		server.Start()
+		defer server.Stop()
+	}
+
+	// the target on port 15903 does not answer at all
+	targets, err := ParseTargets("127.0.0.1:15901|127.0.0.1:15902|127.0.0.1:15903")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewBalancedUdpProxy("127.0.0.1:15900", targets)
+	proxy.SetName("UdpTestProxy")
+	proxy.HealthChecker = NewHealthChecker("udp", proxy.Balancer)
+	proxy.HealthChecker.Interval = 50 * time.Millisecond
+	proxy.HealthChecker.Timeout = 100 * time.Millisecond
+	proxy.HealthChecker.HealthyThreshold = 1
+	proxy.HealthChecker.UnhealthyThreshold = 1
+	proxy.HealthChecker.Send = []byte("PING")
+	proxy.HealthChecker.Expect = []byte("PONG")
+	proxy.Start()
+	defer proxy.Stop()
+
+	// the answering target is checked last, after the checks of the others failed
+	deadline := time.Now().Add(2 * time.Second)
+	for _, i := range []int{1, 2, 0} {
+		healthy := i == 0
+		for proxy.HealthChecker.IsHealthy(targets[i]) != healthy && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if proxy.HealthChecker.IsHealthy(targets[i]) != healthy {
+			t.Errorf("Expected target %v to have health state %v", targets[i].Address, healthy)
+		}
+	}
+}
@@ -8,15 +8,18 @@ import (
 
 // UdpServer listens for UDP packets and allow to send responses
 type UdpServer struct {
-	Name         string
-	Consumer     func([]byte, *net.UDPAddr)
-	address      string
-	conn         *net.UDPConn
-	running      bool
-	mutex        sync.Mutex
-	receivers    sync.WaitGroup
-	Verbose      bool
-	statsPrinter *StatsPrinter
+	Name      string
+	Consumer  func([]byte, *net.UDPAddr)
+	address   string
+	conn      *net.UDPConn
+	localAddr net.Addr
+	running   bool
+	mutex     sync.Mutex
+	receivers sync.WaitGroup
+	Verbose   bool
+	// SocketOptions tune the socket, if set
+	SocketOptions *SocketOptions
+	statsPrinter  *StatsPrinter
 }
 
 // NewUdpServer creates a new UDP server
@@ -38,23 +41,17 @@ func (s *UdpServer) Start() {
 	}
 	s.running = true
 
-	addr, err := net.ResolveUDPAddr("udp", s.address)
-	if err != nil {
-		log.Printf("%v - Could resolve address %v: %v", s.Name, s.address, err)
-		return
-	}
-
-	s.conn, err = net.ListenUDP("udp", addr)
+	var err error
+	s.conn, err = s.SocketOptions.listenUdp(s.address)
 	if err != nil {
 		log.Printf("%v - Could not listen at %v: %v", s.Name, s.address, err)
 		return
 	}
+	s.localAddr = s.conn.LocalAddr()
 
-	if err := s.conn.SetReadBuffer(maxDatagramSize); err != nil {
-		log.Printf("%v - Could not set read buffer: %v", s.Name, err)
-	}
-
-	go s.receive()
+	// registered before starting, so that Stop always waits for the receiver
+	s.receivers.Add(1)
+	go s.receive(s.conn)
 }
 
 // Stop the server and close all existing connections
@@ -71,6 +68,12 @@ func (s *UdpServer) Stop() {
 	}
 }
 
+// LocalAddr returns the address the server listens on, or nil if it did not listen yet.
+// It does not lock the server, so that consumers can call it while the server is stopping.
+func (s *UdpServer) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
 // Respond to the given addr, via the server connection
 func (s *UdpServer) Respond(data []byte, addr *net.UDPAddr) {
 	s.mutex.Lock()
@@ -86,16 +89,14 @@ func (s *UdpServer) Respond(data []byte, addr *net.UDPAddr) {
 	}
 }
 
-func (s *UdpServer) receive() {
+func (s *UdpServer) receive(conn *net.UDPConn) {
 	log.Printf("%v - Listening on %s", s.Name, s.address)
 	defer log.Printf("%v - Stop listening on %s", s.Name, s.address)
-
-	s.receivers.Add(1)
 	defer s.receivers.Done()
 
 	data := make([]byte, maxDatagramSize)
 	for {
-		n, clientAddr, err := s.conn.ReadFromUDP(data)
+		n, clientAddr, err := conn.ReadFromUDP(data)
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); !ok || opErr.Err.Error() != "use of closed network connection" {
 				log.Printf("%v - Could not receive data from %s: %s", s.Name, s.address, err)